@@ -3,60 +3,160 @@ package chordnode
 import (
 	"chord/utils"
 
+	"context"
 	"fmt"
-	"strconv"
+	"math/big"
+	"math/rand"
+	"sort"
 	"strings"
 	"sync"
 	"errors"
+	"time"
 
-	"github.com/Jeffail/gabs"
 	zmq "github.com/pebbe/zmq4"
 )
 
 /*
-A node capable of joining and operating a Chord ring
+A node capable of joining and operating a Chord ring. Requests are served by
+several workers at once, alongside the maintenance tasks, so the ring state
+(InRing, Predecessor, Successor, SuccessorList, Table and the maps) is only
+touched with mux held. Hold mux for reads and updates alone, never across a send.
 */
 type ChordNode struct {
-	ID		uint32
-	Predecessor	*uint32
-	Successor	*uint32
-	Table		[32](*uint32)
+	ID		utils.ID
+	Bits		int // Width of the ring's id space. Change it with SetBits.
+	Predecessor	*utils.NodeRef
+	Successor	*utils.NodeRef
+	SuccessorList	[]utils.NodeRef // The next nodes around the ring, starting with Successor.
+	SuccessorListSize	int
+	Table		[](*utils.NodeRef) // One finger per bit of the id space.
 	Address		string
 	Port		int
+	Virtual		int // Which of its host's virtual nodes this is, 0 for a node of its own.
 	InRing		bool
 	Data		map[string]string
-	Directory	*map[uint32]string
+	Replicas	map[utils.ID]map[string]string // Copies of other nodes' Data, by owner.
+	ReplicationFactor	int
+	LookupMode	string // How lookups we start travel, utils.LOOKUP_RECURSIVE or utils.LOOKUP_ITERATIVE.
+	Routing		string // How we pick the next hop, ROUTE_PROGRESS or ROUTE_PROXIMITY. Change it with SetRouting.
+	Transport	utils.Transport `json:"-"`
+	Codec		utils.Codec `json:"-"` // Wire format of the requests this node sends.
+	Clock		utils.Clock `json:"-"`
+	Detector	FailureDetector `json:"-"` // Decides when peers that stop answering are dead.
 	mux		sync.Mutex
-	curr_finger	int
+	curr_finger	int // The finger FixRingFingers refreshes next.
+	handoff		*handoff // Keys being transferred to our predecessor, if any.
+	migrating	bool
+	joinWrites	map[string]bool // Keys written since joining, until our successor hands its keys over.
+	peers		map[string]*PeerInfo // Result of the hello handshake, by address.
+	failedHellos	map[string]failedHello // Handshakes that failed lately, by address.
+	rtt		rttTable
+	host		*Host // The host serving this node, if it is a virtual node.
+	faults		faultInjector
+	known		map[string]utils.ID // Peers to check the ring through, by address. See RepairRing.
+	rand		*rand.Rand // Picks among known peers.
+	Maintenance	MaintenanceConfig `json:"-"`
+	stopTasks	chan struct{} // Closed to stop the maintenance tasks.
+	tasks		sync.WaitGroup
+	cancel		context.CancelFunc // Stops the transport started by Start.
+	stopped		chan struct{} // Closed once the node has stopped.
+	serveErr	error
 	SecondNode	bool // This is a janky way for node that created the ring to take
 			     // special action when the second node joins.
 }
 
+// A batch of keys in transit to a new predecessor. Writes to those keys wait on done.
+type handoff struct {
+	keys	map[string]bool
+	done	chan struct{}
+}
+
+// What a peer agreed to in the hello handshake.
+type PeerInfo struct {
+	Version		int
+	Features	map[string]bool
+	Bits		int
+}
+
+// A handshake that failed, kept so we do not ask again for HELLO_RETRY_INTERVAL.
+type failedHello struct {
+	err	error
+	at	time.Time
+}
+
+// How long a failed handshake is remembered before the peer is asked again.
+const HELLO_RETRY_INTERVAL = 2 * time.Second
+
+// Number of successors each owner copies its keys to.
+const DEFAULT_REPLICATION_FACTOR = 2
+
+// Number of successors each node tracks for failover.
+const DEFAULT_SUCCESSOR_LIST_SIZE = 3
+
 /*
-Returns a new ChordNode
+Returns a new ChordNode. A nil transport defaults to ZeroMQ.
 */
-func New(address string, port int, directory *map[uint32]string) *ChordNode {
-	id := utils.ComputeId(fmt.Sprintf("tcp://%s:%d", address, port))
+func New(address string, port int, transport utils.Transport) *ChordNode {
 	n := ChordNode{
-		ID:      id,
+		Bits:    utils.DEFAULT_BITS,
 		Address: address,
 		Port:    port}
-	n.Successor = new(uint32)
-	for i := 0; i < len(n.Table); i++ {
-		n.Table[i] = nil
-	}
+	n.ID = utils.ComputeId(n.GetOwnAddress(), n.Bits)
+	n.Successor = nil
+	n.SuccessorList = []utils.NodeRef{}
+	n.SuccessorListSize = DEFAULT_SUCCESSOR_LIST_SIZE
+	n.Table = make([]*utils.NodeRef, n.Bits)
 	n.Data = make(map[string]string)
-	n.Directory = directory
+	n.Replicas = make(map[utils.ID]map[string]string)
+	n.peers = make(map[string]*PeerInfo)
+	n.failedHellos = make(map[string]failedHello)
+	n.known = make(map[string]utils.ID)
+	n.ReplicationFactor = DEFAULT_REPLICATION_FACTOR
+	n.LookupMode = utils.LOOKUP_RECURSIVE
+	n.Routing = ROUTE_PROGRESS
+	n.Transport = transport
+	if n.Transport == nil {
+		n.Transport = utils.ZmqTransport{}
+	}
+	n.Codec = utils.JSON
+	n.Clock = utils.RealClock{}
+	n.Detector = NewStrikesDetector(DEFAULT_SUSPECT_STRIKES, DEFAULT_DEAD_STRIKES)
+	n.Maintenance = DefaultMaintenance
 	n.InRing = false
 	n.curr_finger = 0
 	n.SecondNode = true
 	return &n
 }
 
+/*
+Use an id space of bits bits, which every node in the ring must share. This
+changes the node's id, so it is only allowed outside a ring.
+*/
+func (n *ChordNode) SetBits(bits int) error {
+	err := utils.ValidateBits(bits)
+	if err != nil {
+		return err
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.InRing {
+		return errors.New("Cannot change the id space of a node in a ring")
+	}
+	n.Bits = bits
+	n.ID = utils.ComputeId(n.GetOwnAddress(), bits)
+	n.Table = make([]*utils.NodeRef, bits)
+	n.curr_finger = 0
+	return nil
+}
+
 /**
  * Try to find an open port.
  */
-func GenerateRandomNode(directory *map[uint32]string) *ChordNode {
+func GenerateRandomNode() *ChordNode {
+	return New(utils.Localhost, randomPort(), utils.ZmqTransport{})
+}
+
+func randomPort() int {
 	context, _ := zmq.NewContext()
 	defer context.Term()
 
@@ -71,510 +171,1586 @@ func GenerateRandomNode(directory *map[uint32]string) *ChordNode {
 		randPort = utils.GetRandomPort()
 		err = socket.Connect(fmt.Sprintf("tcp://%s:%d", utils.Localhost, randPort))
 	}
-	return New(utils.Localhost, randPort, directory)
+	return randPort
+}
+
+/*
+Send m to the node at address in this node's wire format. A command newer than
+the protocol version the peer agreed to in its handshake is not sent at all;
+peers we have not shaken hands with are sent anything, and answer with an error
+if they do not know it.
+*/
+func (n *ChordNode) send(m utils.Message, address string) (string, error) {
+	if version := utils.CommandVersion(m.Command()); version > utils.MIN_PROTOCOL_VERSION {
+		n.mux.Lock()
+		info, present := n.peers[address]
+		n.mux.Unlock()
+		if present && info.Version < version {
+			return "", fmt.Errorf("%s speaks protocol version %d, %s needs %d", address, info.Version, m.Command(), version)
+		}
+	}
+	msg, err := n.Codec.Encode(m)
+	if err != nil {
+		return "", err
+	}
+	start := n.Clock.Now()
+	response, err := n.transmit(msg, address)
+	if err != nil {
+		n.Detector.Missed(address, n.Clock.Now())
+		return response, err
+	}
+	n.Detector.Heard(address, n.Clock.Now())
+	if timed(m) {
+		n.rtt.observe(address, n.Clock.Now().Sub(start))
+	}
+	return response, err
+}
+
+// Send msg to address unless our fault rules keep it from getting there. Unlike
+// send, this tells the detector nothing.
+func (n *ChordNode) transmit(msg string, address string) (string, error) {
+	if n.unreachable(address) {
+		return "", &utils.SendError{Address: address, Attempts: 1, Err: utils.ErrTimeout}
+	}
+	return n.Transport.SendMessage(msg, address)
+}
+
+/*
+Decode a reply from address into v. A garbled reply is no better sign of life
+than none, so it counts as a miss; an error reply is still an answer.
+*/
+func (n *ChordNode) decodeReply(address string, response string, v interface{}) error {
+	err := utils.DecodeReply(response, v)
+	var failed *utils.MessageError
+	if err != nil && (!errors.As(err, &failed) || failed.Code == utils.ERR_MALFORMED) {
+		n.Detector.Missed(address, n.Clock.Now())
+	}
+	return err
+}
+
+// This node as others refer to it.
+func (n *ChordNode) self() utils.NodeRef {
+	return utils.NodeRef{ID: n.ID, Address: n.GetOwnAddress()}
+}
+
+func (n *ChordNode) successor() *utils.NodeRef {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return copyRef(n.Successor)
+}
+
+func (n *ChordNode) predecessor() *utils.NodeRef {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return copyRef(n.Predecessor)
+}
+
+func (n *ChordNode) successorList() []utils.NodeRef {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return append([]utils.NodeRef{}, n.SuccessorList...)
+}
+
+func (n *ChordNode) IsInRing() bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.InRing
+}
+
+// A pointer to a copy of node. Node pointers are replaced rather than updated
+// in place, so they can be shared between fields.
+func refTo(node utils.NodeRef) *utils.NodeRef {
+	return &node
+}
+
+func copyRef(node *utils.NodeRef) *utils.NodeRef {
+	if node == nil {
+		return nil
+	}
+	return refTo(*node)
 }
 
-func (n ChordNode) Print() {
+func (n *ChordNode) Print() {
 	fmt.Printf("%+v\n", n)
 }
 
 
 // Respond to an instruction to join a chord ring
-func (n *ChordNode) CreateRing(msg *gabs.Container) string {
+func (n *ChordNode) CreateRing() *utils.StatusReply {
 	n.mux.Lock()
 	n.Predecessor = nil
-	n.Successor = new(uint32)
-	*(n.Successor) = n.ID
+	n.Successor = refTo(n.self())
+	n.SuccessorList = []utils.NodeRef{n.self()}
 	n.InRing = true
 	n.SecondNode = false
 	n.mux.Unlock()
 
-	jsonObj := gabs.New()
-	jsonObj.Set("ok", "status")
-	msg.Merge(jsonObj)
-
-	return msg.String()
+	return &utils.StatusReply{Status: utils.STATUS_OK}
 }
 
 // Respond to an instruction to join a chord ring
-func (n *ChordNode) JoinRing(msg *gabs.Container) string {
-	jsonObj := gabs.New()
-	sponsorAddress := msg.Path("sponsoring-node").Data().(string)
-	newmsg := utils.FindRingSuccessorCommand(n.ID, n.GetOwnAddress())
-	response_from_sponsor, err := utils.SendMessage(newmsg, sponsorAddress)
+func (n *ChordNode) JoinRing(sponsorAddress string) *utils.StatusReply {
+	_, err := n.Handshake(sponsorAddress)
+	if err != nil {
+		return utils.FailureReply(err)
+	}
+	newmsg := &utils.FindRingSuccessorRequest{ID: n.ID, ReplyTo: n.GetOwnAddress()}
+	response_from_sponsor, err := n.send(newmsg, sponsorAddress)
+	var reply utils.FindRingSuccessorReply
+	if err == nil {
+		err = utils.DecodeReply(response_from_sponsor, &reply)
+	}
 	if err != nil {
-		jsonObj.Set("failure", "error")
+		return utils.FailureReply(err)
 	} else {
-		jsonParsed, _ := gabs.ParseJSON([]byte(response_from_sponsor))
-		id, _ := utils.ParseToUInt32(jsonParsed.Path("id").String())
+		succ := reply.Node()
 
 		n.mux.Lock()
 		n.Predecessor = nil
-		if n.Successor == nil {
-			n.Successor = new(uint32)
-		}
-		*(n.Successor) = id
+		n.Successor = refTo(succ)
+		n.SuccessorList = []utils.NodeRef{succ}
 		n.InRing = true
+		n.joinWrites = map[string]bool{}
 		// Init Finger table
-		n.Table[0] = new(uint32)
-		*(n.Table[0]) = id
+		n.Table[0] = refTo(succ)
 		n.mux.Unlock()
 
-		jsonObj.Set("ok", "status")
+		utils.Debug("[JoinRing: %s] %s", fmt.Sprint(n.ID), n.InitRingFingers())
+		return &utils.StatusReply{Status: utils.STATUS_OK}
 	}
-
-	msg.Merge(jsonObj)
-
-	return msg.String()
 }
 
 func (n *ChordNode) GetOwnAddress() string {
-	return fmt.Sprintf("tcp://%s:%d", n.Address, n.Port)
+	return utils.VirtualAddress(fmt.Sprintf("tcp://%s:%d", n.Address, n.Port), n.Virtual)
 }
 
-func (n *ChordNode) LeaveRing(msg *gabs.Container) string {
-	mode := msg.Path("mode").Data().(string)
+func (n *ChordNode) LeaveRing(mode string) *utils.StatusReply {
 	utils.Debug("[LeaveRing: %s] leaving with mode: %s\n", fmt.Sprint(n.ID), mode)
 
 	// Leave gracefully and inform others
 	if strings.Compare(mode, "orderly") == 0 {
-		// notify predecessor and successor
-		successorAddress, present := (*n.Directory)[*(n.Successor)]
-		orderlyLeaveMsg := utils.NotifyOrderlyLeaveCommand(n.ID, n.Predecessor, n.Successor)
-		utils.Debug("[LeavRing: %s] Sending leave msg: %s to successor: %s\n", fmt.Sprint(n.ID), fmt.Sprint(*(n.Successor)), orderlyLeaveMsg)
-		_, _ = utils.SendMessage(orderlyLeaveMsg, successorAddress)
-		if (n.Predecessor != nil) {
-			predecessorAddress, _ := (*n.Directory)[*(n.Predecessor)]
-			utils.Debug("[LeavRing: %s] Sending leave msg: %s to predecessor: %s\n", fmt.Sprint(n.ID), fmt.Sprint(*(n.Predecessor)), orderlyLeaveMsg)
-			_, _ = utils.SendMessage(orderlyLeaveMsg, predecessorAddress)
-		}
-
-		myAddress, _ := n.GetSocketAddress()
-		if !present {
-			// TODO:
-			// Look in finger table // find closest alive successor
-			fmt.Println("Finger table entry, find closest alive successor")
-		} else {
-			// This is iterative and painful - can we send it all at once?
-			for k, v := range n.Data {
-				putCommand := utils.PutCommand(k, v, myAddress)
-				// TODO: Verify reply below?
-				reply, err := utils.SendMessage(putCommand, successorAddress)
-				if (err != nil) {
-
-				} else {
-					fmt.Println("k:%s v:%s reply:%s", k, v, reply)
-				}
-			}
+		// Hand our keys to the successor before anyone is told we are gone. If no
+		// candidate acknowledges, stay in the ring rather than lose the data.
+		successor, err := n.handOffData()
+		if err != nil {
+			utils.Debug("[LeaveRing: %s] Unable to hand off data: %s\n", fmt.Sprint(n.ID), err.Error())
+			return utils.FailureReply(err)
 		}
 
-
+		// notify predecessor and successor
+		orderlyLeaveMsg := n.leaveNotice(&successor)
+		utils.Debug("[LeavRing: %s] Sending leave msg to successor: %s\n", fmt.Sprint(n.ID), fmt.Sprint(successor.ID))
+		_, _ = n.send(orderlyLeaveMsg, successor.Address)
+		if predecessor := n.predecessor(); predecessor != nil {
+			utils.Debug("[LeavRing: %s] Sending leave msg to predecessor: %s\n", fmt.Sprint(n.ID), fmt.Sprint(predecessor.ID))
+			_, _ = n.send(orderlyLeaveMsg, predecessor.Address)
+		}
 	}
 	n.mux.Lock()
 	n.InRing = false
 	n.Predecessor = nil
 	n.Successor = nil
-	for k := 0; k < 32; k++ {
+	n.SuccessorList = []utils.NodeRef{}
+	for k := range n.Table {
 		n.Table[k] = nil
 	}
+	n.known = make(map[string]utils.ID)
 	n.mux.Unlock()
 
-	jsonObj := gabs.New()
-	jsonObj.Set("ok", "status")
-	msg.Merge(jsonObj)
+	return &utils.StatusReply{Status: utils.STATUS_OK}
+}
+
+// Tell a neighbour that we are leaving, and who takes our place on either side.
+func (n *ChordNode) leaveNotice(successor *utils.NodeRef) *utils.NotifyOrderlyLeaveRequest {
+	m := &utils.NotifyOrderlyLeaveRequest{Leaver: n.ID}
+	if predecessor := n.predecessor(); predecessor != nil {
+		m.Predecessor = &predecessor.ID
+		m.PredecessorAddress = predecessor.Address
+	}
+	if successor != nil {
+		m.Successor = &successor.ID
+		m.SuccessorAddress = successor.Address
+	}
+	return m
+}
+
+// Keys per bulk-put message.
+const BULK_PUT_CHUNK_SIZE = 256
+// Attempts per hand-off candidate before moving to the next one.
+const HANDOFF_RETRIES = 3
+const HANDOFF_RETRY_DELAY = 100 * time.Millisecond
 
-	return msg.String()
+// Nodes that may take over our keys, in ring order: the successor list, then
+// the finger table.
+func (n *ChordNode) handOffCandidates() []utils.NodeRef {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	candidates := []utils.NodeRef{}
+	seen := map[utils.ID]bool{n.ID: true}
+	add := func(node utils.NodeRef) {
+		if !seen[node.ID] {
+			seen[node.ID] = true
+			candidates = append(candidates, node)
+		}
+	}
+	if n.Successor != nil {
+		add(*(n.Successor))
+	}
+	for _, node := range n.SuccessorList {
+		add(node)
+	}
+	for k := range n.Table {
+		if n.Table[k] != nil {
+			add(*(n.Table[k]))
+		}
+	}
+	return candidates
 }
 
-func (n ChordNode) InitRingFingers() string {
-	return ""
+// Ship all of our Data to the first candidate that acknowledges every chunk.
+// Returns the node that took the keys.
+func (n *ChordNode) handOffData() (utils.NodeRef, error) {
+	n.mux.Lock()
+	chunks := []map[string]string{}
+	chunk := map[string]string{}
+	// In order, so that a simulated run splits the keys the same way every time.
+	for _, k := range sortedKeys(n.Data) {
+		chunk[k] = n.Data[k]
+		if len(chunk) == BULK_PUT_CHUNK_SIZE {
+			chunks = append(chunks, chunk)
+			chunk = map[string]string{}
+		}
+	}
+	if len(chunk) > 0 || len(chunks) == 0 {
+		chunks = append(chunks, chunk)
+	}
+	n.mux.Unlock()
+
+	for _, candidate := range n.handOffCandidates() {
+		// Older peers only take keys by put, which is routed to the owner, and
+		// that is still us. A later candidate may take them in bulk instead.
+		if !n.peerSupports(candidate.Address, utils.FEATURE_BATCHING) {
+			utils.Debug("[handOffData: %s] %s cannot take keys in bulk\n", fmt.Sprint(n.ID), fmt.Sprint(candidate.ID))
+			continue
+		}
+		if n.sendChunks(chunks, candidate.Address) {
+			return candidate, nil
+		}
+	}
+	return utils.NodeRef{}, errors.New("No successor acknowledged the hand-off")
+}
+
+func (n *ChordNode) sendChunks(chunks []map[string]string, address string) bool {
+	for _, chunk := range chunks {
+		acked := false
+		for attempt := 0; attempt < HANDOFF_RETRIES && !acked; attempt++ {
+			if attempt > 0 {
+				n.Clock.Sleep(HANDOFF_RETRY_DELAY * time.Duration(attempt))
+			}
+			response, err := n.send(&utils.BulkPutRequest{From: n.ID, Items: chunk}, address)
+			if err != nil {
+				continue
+			}
+			var reply utils.CountReply
+			if utils.DecodeReply(response, &reply) != nil {
+				continue
+			}
+			acked = reply.Status == utils.STATUS_OK && reply.Count == len(chunk)
+		}
+		if !acked {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(items map[string]string) []string {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Store a batch of keys handed to us by from, our predecessor, as it leaves. Its
+keys are ours once it has gone. That includes a leaver between us and the
+predecessor we know of, whose notify has not reached us yet or whose successor
+failed before it could take the keys. From anyone else we only take keys we own
+already, and refuse the whole batch otherwise: lookups would never find the
+others here.
+*/
+func (n *ChordNode) BulkPut(from utils.ID, items map[string]string) (*utils.CountReply, error) {
+	n.mux.Lock()
+	if !n.precededBy(from) {
+		for _, k := range sortedKeys(items) {
+			if !n.owns(utils.ComputeId(k, n.Bits)) {
+				n.mux.Unlock()
+				return nil, fmt.Errorf("%q is not ours to store", k)
+			}
+		}
+	}
+	for k, v := range items {
+		n.Data[k] = v
+	}
+	n.mux.Unlock()
+	if len(items) > 0 {
+		n.replicateChange(items, nil)
+	}
+	return &utils.CountReply{Status: utils.STATUS_OK, Count: len(items)}, nil
+}
+
+/*
+Fill the finger table on joining by asking our successor where each finger
+starts. A finger whose start comes before the previous finger's node points at
+that node too, so most fingers of a small ring need no lookup.
+*/
+func (n *ChordNode) InitRingFingers() string {
+	successor := n.successor()
+	if successor == nil {
+		return "No successor to ask"
+	}
+	table := make([]*utils.NodeRef, n.Bits)
+	// The first finger starts at n + 1, so it is our successor.
+	table[0] = successor
+	lookups := 0
+	for i := 1; i < len(table); i++ {
+		start := utils.FingerStart(n.ID, i, n.Bits)
+		if previous := table[i-1]; start == n.ID || utils.IsBetween(n.ID, previous.ID, start) {
+			table[i] = previous
+			continue
+		}
+		request := &utils.FindRingSuccessorRequest{ID: start, ReplyTo: n.GetOwnAddress()}
+		response, err := n.send(request, successor.Address)
+		var reply utils.FindRingSuccessorReply
+		if err == nil {
+			err = utils.DecodeReply(response, &reply)
+		}
+		if err != nil {
+			// FixRingFingers fills in the rest.
+			table = table[:i]
+			break
+		}
+		lookups++
+		table[i] = refTo(reply.Node())
+	}
+	n.mux.Lock()
+	if n.InRing {
+		copy(n.Table, table)
+	}
+	n.mux.Unlock()
+	return fmt.Sprintf("Initialized %d fingers with %d lookups\n", len(table), lookups)
 }
 
+// Refresh the next finger, so that every finger is refreshed once per Bits calls.
 func (n *ChordNode) FixRingFingers() string {
 	n.mux.Lock()
-	n.curr_finger = n.curr_finger + 1
-	if n.curr_finger > 31 {
-		n.curr_finger = 0
+	// A lone node would only be asking itself.
+	if n.Successor == nil || n.Successor.ID == n.ID {
+		n.mux.Unlock()
+		return "No fingers to fix"
+	}
+	finger := n.curr_finger
+	n.curr_finger = (n.curr_finger + 1) % len(n.Table)
+	// Rather no finger than one we have given up on; lookups fall back on the others.
+	for k, node := range n.Table {
+		if node != nil && n.PeerState(node.Address) == PEER_DEAD {
+			n.Table[k] = nil
+		}
 	}
-	// Ask the closest preceding finger
-	finger_id := n.ID + (uint32)(2^(n.curr_finger)) // Rely on integer wraparound
-	request := utils.FindRingSuccessorCommand(finger_id, n.GetOwnAddress())
-	directory := *n.Directory
-	response_from_successor, err := utils.SendMessage(request, directory[*(n.Successor)])
+	n.mux.Unlock()
+
+	start := utils.FingerStart(n.ID, finger, n.Bits)
+	node, err := n.FindKeyOwner(start)
 	if err != nil {
-		// TODO: we could possibly try again with another node in the finger table.
-		n.mux.Unlock()
 		return "Failure Fixing Finger"
-	} else {
-		jsonParsed, _ := gabs.ParseJSON([]byte(response_from_successor))
-		id, _ := utils.ParseToUInt32(jsonParsed.Path("id").String())
-		if n.Table[n.curr_finger] == nil {
-			n.Table[n.curr_finger] = new(uint32)
-		}
-		*(n.Table[n.curr_finger]) = id
-		n.mux.Unlock()
-		return fmt.Sprintf("Success Fixing Finger %d with value %d\n", finger_id, id)
 	}
+	n.measure(node)
+	n.mux.Lock()
+	// Leaving the ring clears the table; don't put a finger back into it.
+	if n.InRing {
+		n.Table[finger] = refTo(node)
+		n.remember(node)
+	}
+	n.mux.Unlock()
+	return fmt.Sprintf("Success Fixing Finger %d at %s with value %s\n", finger, start, node.ID)
+}
 
+/*
+Make found our successor. The old successors stay on the list behind it to fail
+over to, in case found does not answer, until the list is refreshed from it.
+Called with mux held.
+*/
+func (n *ChordNode) adoptSuccessor(found utils.NodeRef) {
+	list := append([]utils.NodeRef{found}, n.SuccessorList...)
+	if len(list) > n.SuccessorListSize {
+		list = list[:n.SuccessorListSize]
+	}
+	n.Successor = refTo(found)
+	n.SuccessorList = list
 }
 
 func (n *ChordNode) StabilizeRing() string {
-	if (n.Successor != nil) {
-		succ_addr := (*n.Directory)[*(n.Successor)]
-		cmd := utils.FindRingPredecessorCommand()
-		response, err := utils.SendMessage(cmd, succ_addr)
+	if current := n.successor(); current != nil {
+		response, err := n.send(&utils.FindRingPredecessorRequest{}, current.Address)
+		var reply utils.PredecessorReply
+		if err == nil {
+			err = n.decodeReply(current.Address, response, &reply)
+		}
 		if err != nil {
+			if state := n.PeerState(current.Address); state != PEER_DEAD {
+				return fmt.Sprintf("Successor %s is %s. Keeping it for now", current.ID, state)
+			}
+			if n.failoverSuccessor() {
+				return "Successor failed. Failed over to next entry in successor list"
+			}
 			return "Stabilization Failed due to lack of response from Successor"
 		} else {
-			successor := *(n.Successor)
-			if response != "No Predecessor" {
-				succ_pred, _ := utils.ParseToUInt32(response)
-				// Successor's Predecessor is in between this node and Successor
-				if utils.IsBetween(n.ID, *(n.Successor), succ_pred) {
-					n.mux.Lock()
-					successor = succ_pred
-					*(n.Successor) = successor
-					n.mux.Unlock()
+			successor := *current
+			if succ_pred := reply.Node(); succ_pred != nil {
+				// Our successor vouches for a node we gave up on. It may have come back.
+				if n.PeerState(succ_pred.Address) == PEER_DEAD {
+					n.send(&utils.PingRequest{}, succ_pred.Address)
+				}
+				// Successor's Predecessor is in between this node and Successor, and
+				// not one we have given up on but our successor has yet to.
+				n.mux.Lock()
+				if n.Successor != nil && n.Successor.ID == current.ID && utils.IsBetween(n.ID, current.ID, succ_pred.ID) && n.PeerState(succ_pred.Address) != PEER_DEAD {
+					successor = *succ_pred
+					n.adoptSuccessor(successor)
 				}
+				n.mux.Unlock()
 			}
 			// Send notify message to the new successor.
-			cmd := utils.RingNotifyCommand(n.ID, n.GetOwnAddress())
-			succ_addr := (*n.Directory)[successor]
-			_, err := utils.SendMessage(cmd, succ_addr)
+			cmd := &utils.RingNotifyRequest{ID: n.ID, ReplyTo: n.GetOwnAddress()}
+			_, err := n.send(cmd, successor.Address)
 			if err != nil {
-				utils.Debug("[Stabilize %s] Error from successor %s\n", fmt.Sprint(n.ID), fmt.Sprint(successor))
+				utils.Debug("[Stabilize %s] Error from successor %s\n", fmt.Sprint(n.ID), fmt.Sprint(successor.ID))
 				return "Error Stabilizing Ring"
 			} else {
-				utils.Debug("[Stabilize %s] Error from successor %s\n", fmt.Sprint(n.ID), fmt.Sprint(successor))
+				n.refreshSuccessorList(successor)
+				utils.Debug("[Stabilize %s] Notified successor %s\n", fmt.Sprint(n.ID), fmt.Sprint(successor.ID))
 				return "Stabilization Successful!"
 			}
 		}
 	} else {
-		// Successor failed so update with some value from the finger table
-		for k := 0; k < 32; k++ {
+		// Successor failed so update with the successor list or, failing that, the finger table
+		if n.failoverSuccessor() {
+			return "Successor set from successor list"
+		}
+		n.mux.Lock()
+		defer n.mux.Unlock()
+		for k := range n.Table {
 			if n.Table[k] != nil {
-				*(n.Successor) = *(n.Table[k])
-				break;
+				n.Successor = refTo(*(n.Table[k]))
+				n.SuccessorList = []utils.NodeRef{*(n.Table[k])}
+				return "Successor set from finger table"
 			}
 		}
 	}
 	return "Could not stabilize. No Successor."
 }
 
-func (n *ChordNode) RingNotify(id uint32, replyTo string) string {
+// Drop the current successor and promote the next entry of the successor list.
+// Returns false if the list holds no other candidate.
+func (n *ChordNode) failoverSuccessor() bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	// Skip the successor that failed, and any others we have given up on.
+	for len(n.SuccessorList) > 0 {
+		first := n.SuccessorList[0]
+		if (n.Successor == nil || first.ID != n.Successor.ID) && n.PeerState(first.Address) != PEER_DEAD {
+			break
+		}
+		n.SuccessorList = n.SuccessorList[1:]
+	}
+	if len(n.SuccessorList) == 0 {
+		return false
+	}
+	n.Successor = refTo(n.SuccessorList[0])
+	utils.Debug("[Stabilize %s] Failing over to successor %s\n", fmt.Sprint(n.ID), fmt.Sprint(n.SuccessorList[0].ID))
+	return true
+}
+
+// Rebuild the successor list from our successor's own list.
+func (n *ChordNode) refreshSuccessorList(successor utils.NodeRef) {
+	response, err := n.send(&utils.GetSuccessorListRequest{}, successor.Address)
+	if err != nil {
+		return
+	}
+	var reply utils.SuccessorListReply
+	if utils.DecodeReply(response, &reply) != nil {
+		return
+	}
+	list := []utils.NodeRef{successor}
+	for _, node := range reply.Nodes {
+		if len(list) >= n.SuccessorListSize {
+			break
+		}
+		// Stop once the list wraps back around to us.
+		if node.ID == n.ID || node.ID == successor.ID {
+			break
+		}
+		list = append(list, node)
+	}
+	n.mux.Lock()
+	if n.Successor != nil && n.Successor.ID == successor.ID {
+		n.SuccessorList = list
+	}
+	n.remember(list...)
+	n.mux.Unlock()
+}
+
+func (n *ChordNode) GetSuccessorList() *utils.SuccessorListReply {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	reply := utils.SuccessorListReply{Successors: []utils.ID{}, Nodes: append([]utils.NodeRef{}, n.SuccessorList...)}
+	for _, node := range n.SuccessorList {
+		reply.Successors = append(reply.Successors, node.ID)
+	}
+	return &reply
+}
+
+func (n *ChordNode) RingNotify(id utils.ID, replyTo string) string {
+	n.mux.Lock()
 	if (n.Predecessor == nil && n.ID != id) {
-		n.Predecessor = new(uint32)
-		*(n.Predecessor) = id
-		return fmt.Sprintf("Predecessor set to %d\n", id)
-	} else if n.Predecessor != nil && (utils.IsBetween(*(n.Predecessor), n.ID, id)) {
-		*(n.Predecessor) = id
-		return fmt.Sprintf("Predecessor set to %d\n", id)
+		n.Predecessor = &utils.NodeRef{ID: id, Address: replyTo}
+		n.remember(*n.Predecessor)
+		n.mux.Unlock()
+		n.promoteReplicasAfter(id)
+		n.startKeyMigration()
+		return fmt.Sprintf("Predecessor set to %s\n", id)
+	} else if n.Predecessor != nil && (utils.IsBetween(n.Predecessor.ID, n.ID, id)) {
+		n.Predecessor = &utils.NodeRef{ID: id, Address: replyTo}
+		n.remember(*n.Predecessor)
+		n.mux.Unlock()
+		n.startKeyMigration()
+		return fmt.Sprintf("Predecessor set to %s\n", id)
 	}
+	n.mux.Unlock()
 	return "No Predecessor set\n"
 }
 
-func (n ChordNode) GetRingFingers() string {
-	return ""
+// Start handing keys outside (predecessor, n] to the predecessor, unless a
+// migration is already running. A running migration picks up predecessor changes.
+func (n *ChordNode) startKeyMigration() {
+	n.mux.Lock()
+	if n.migrating {
+		n.mux.Unlock()
+		return
+	}
+	n.migrating = true
+	n.mux.Unlock()
+	n.Clock.Go(n.migrateKeys)
+}
+
+func (n *ChordNode) migrateKeys() {
+	first := true
+	for {
+		n.mux.Lock()
+		if n.Predecessor == nil {
+			n.migrating = false
+			n.mux.Unlock()
+			return
+		}
+		pred := *(n.Predecessor)
+		items := map[string]string{}
+		for k, v := range n.Data {
+			if n.strays(k) {
+				items[k] = v
+			}
+		}
+		// The first transfer is sent even when empty, so the new node knows
+		// its hand-off is complete.
+		if len(items) == 0 && !first {
+			n.migrating = false
+			n.mux.Unlock()
+			return
+		}
+		h := &handoff{keys: map[string]bool{}, done: make(chan struct{})}
+		for k := range items {
+			h.keys[k] = true
+		}
+		n.handoff = h
+		n.mux.Unlock()
+
+		utils.Debug("[KeyMigration: %s] Transferring %s keys to %s\n", fmt.Sprint(n.ID), fmt.Sprint(len(items)), fmt.Sprint(pred.ID))
+		response, err := n.send(&utils.TransferKeysRequest{From: n.ID, Items: items}, pred.Address)
+		if err == nil {
+			var reply utils.StatusReply
+			err = n.decodeReply(pred.Address, response, &reply)
+		}
+
+		n.mux.Lock()
+		if err == nil {
+			for k := range items {
+				delete(n.Data, k)
+			}
+		}
+		n.handoff = nil
+		close(h.done)
+		if err != nil {
+			n.migrating = false
+		}
+		n.mux.Unlock()
+
+		if err != nil {
+			utils.Debug("[KeyMigration: %s] Transfer to %s failed: %s\n", fmt.Sprint(n.ID), fmt.Sprint(pred.ID), err.Error())
+			return
+		}
+		if len(items) > 0 {
+			n.replicateChange(nil, sortedKeys(items))
+		}
+		first = false
+	}
+}
+
+// Block while key is part of an in-progress hand-off, so that the write lands
+// after the transferred value on the new owner.
+func (n *ChordNode) waitForHandoff(key string) {
+	n.mux.Lock()
+	h := n.handoff
+	n.mux.Unlock()
+	if h != nil && h.keys[key] {
+		<-h.done
+	}
 }
 
-func (n *ChordNode) ClosestPrecedingNode(id uint32) uint32 {
-	for i := 31; i >= 0; i-- {
+/*
+Lock mux for a write to key here. A hand-off of key can start after the write
+passed waitForHandoff, while it was being routed; then we wait for that too and
+return false, unlocked, so that the write is routed again to the new owner.
+*/
+func (n *ChordNode) lockForWrite(key string) bool {
+	n.mux.Lock()
+	if h := n.handoff; h != nil && h.keys[key] {
+		n.mux.Unlock()
+		<-h.done
+		return false
+	}
+	return true
+}
+
+// Whether key belongs to our predecessor's side of the ring, and so should be
+// migrated to it. Called with mux held.
+func (n *ChordNode) strays(key string) bool {
+	if n.Predecessor == nil {
+		return false
+	}
+	id := utils.ComputeId(key, n.Bits)
+	return id != n.ID && !utils.IsBetween(n.Predecessor.ID, n.ID, id)
+}
+
+/*
+Accept keys handed over by from, our successor, refusing the whole batch unless
+every key is ours. Before we have a predecessor that is any key our successor
+does not own. Keys written here since we joined are newer than the transferred
+copies and are kept.
+*/
+func (n *ChordNode) AcceptKeys(from utils.ID, items map[string]string) (string, error) {
+	n.mux.Lock()
+	if n.Successor == nil || n.Successor.ID != from || from == n.ID {
+		n.mux.Unlock()
+		return "", fmt.Errorf("%s is not our successor", from)
+	}
+	for _, k := range sortedKeys(items) {
+		id := utils.ComputeId(k, n.Bits)
+		successors := id == from || utils.IsBetween(n.ID, from, id)
+		if !n.owns(id) && (n.Predecessor != nil || successors) {
+			n.mux.Unlock()
+			return "", fmt.Errorf("%q is not ours to store", k)
+		}
+	}
+	accepted := map[string]string{}
+	for k, v := range items {
+		if n.joinWrites != nil && n.joinWrites[k] {
+			continue
+		}
+		n.Data[k] = v
+		accepted[k] = v
+	}
+	n.joinWrites = nil
+	n.mux.Unlock()
+	if len(accepted) > 0 {
+		n.replicateChange(accepted, nil)
+	}
+	return fmt.Sprintf("Accepted %d keys from %s", len(accepted), from), nil
+}
+
+func (n *ChordNode) GetRingFingers() *utils.FingersReply {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	reply := utils.FingersReply{Bits: n.Bits, Fingers: []utils.Finger{}}
+	for i, node := range n.Table {
+		reply.Fingers = append(reply.Fingers, utils.Finger{Start: utils.FingerStart(n.ID, i, n.Bits), Node: copyRef(node)})
+	}
+	return &reply
+}
+
+func (n *ChordNode) ClosestPrecedingNode(id utils.ID) utils.NodeRef {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.closestPrecedingNode(id)
+}
+
+// As ClosestPrecedingNode, with mux held.
+func (n *ChordNode) closestPrecedingNode(id utils.ID) utils.NodeRef {
+	closest := n.self()
+	candidates := []utils.NodeRef{}
+	seen := map[utils.ID]bool{}
+	for i := len(n.Table) - 1; i >= 0; i-- {
 		if (n.Table[i]) != nil {
-			finger_val := *(n.Table[i])
-			if utils.IsBetween(n.ID, id, finger_val) {
-				return finger_val
+			finger := *(n.Table[i])
+			if utils.IsBetween(n.ID, id, finger.ID) && !seen[finger.ID] && n.PeerState(finger.Address) != PEER_DEAD {
+				if len(candidates) == 0 {
+					closest = finger
+				}
+				candidates = append(candidates, finger)
+				seen[finger.ID] = true
 			}
 		}
 	}
-	return n.ID
+	// A successor list entry may be closer than the best finger.
+	for _, succ := range n.SuccessorList {
+		if utils.IsBetween(n.ID, id, succ.ID) && !seen[succ.ID] && n.PeerState(succ.Address) != PEER_DEAD {
+			if utils.IsBetween(closest.ID, id, succ.ID) {
+				closest = succ
+			}
+			candidates = append(candidates, succ)
+			seen[succ.ID] = true
+		}
+	}
+	if n.Routing == ROUTE_PROXIMITY && len(candidates) > 1 {
+		return n.nearestCandidate(id, candidates)
+	}
+	return closest
 }
 
 // {"do": "find-ring-successor", "id": id, "reply-to": address}
-func (n *ChordNode) FindRingSuccessor(id uint32) (uint32, bool, error) {
-	var result uint32
+func (n *ChordNode) FindRingSuccessor(id utils.ID, replyTo string) (utils.NodeRef, bool, error) {
+	var result utils.NodeRef
 	var more bool // Did we reach the end of the chain, or is there more to search?
+	n.mux.Lock()
 	// Special case for when the second node joins, so we can break the cycle of the 
 	// first node's successor being itself.
-	if !n.SecondNode { // Will be set to true for all nodes that didn't create the ring
-		n.mux.Lock()
-		n.Predecessor = new(uint32)
-		*(n.Predecessor) = id
-		n.Successor = new(uint32)
-		*(n.Successor) = id
-		n.Table[0] = new(uint32)
-		*(n.Table[0]) = id
+	// Only a joining node asks for the successor of the id of its own address.
+	if !n.SecondNode && utils.ComputeId(replyTo, n.Bits) == id { // Will be set to true for all nodes that didn't create the ring
+		joiner := utils.NodeRef{ID: id, Address: replyTo}
+		n.Predecessor = refTo(joiner)
+		n.Successor = refTo(joiner)
+		n.SuccessorList = []utils.NodeRef{joiner}
+		n.Table[0] = refTo(joiner)
 		n.SecondNode = true
 		n.mux.Unlock()
-		result = n.ID
-		more = false
+		n.startKeyMigration()
+		return n.self(), false, nil
+	}
+	defer n.mux.Unlock()
+	if n.Successor == nil {
+		return result, false, errors.New("No successor")
 	} else if id == n.ID {
 		result = *(n.Successor)
 		more = false
-	} else if utils.IsBetween(n.ID, *(n.Successor), id) {
-		utils.Debug("\t[FindRingSuccessor: %s] id: %s is between %s and its successor: %s\n", fmt.Sprint(n.ID), fmt.Sprint(id), fmt.Sprint(n.ID), fmt.Sprint(*(n.Successor)))
+	} else if utils.IsBetween(n.ID, n.Successor.ID, id) {
+		utils.Debug("\t[FindRingSuccessor: %s] id: %s is between %s and its successor: %s\n", fmt.Sprint(n.ID), fmt.Sprint(id), fmt.Sprint(n.ID), fmt.Sprint(n.Successor.ID))
 		result = *(n.Successor)
 		more = false
+	} else if succ, found := n.successorListCovers(id); found {
+		result = succ
+		more = false
 	} else {
 		// Return who to ask next.
-		result = n.ClosestPrecedingNode(id)
-		utils.Debug("\t[FindRingSuccessor: %s] For %s, please contact my closeset successor: %s\n", fmt.Sprint(n.ID), fmt.Sprint(id), fmt.Sprint(result))
+		result = n.closestPrecedingNode(id)
+		utils.Debug("\t[FindRingSuccessor: %s] For %s, please contact my closeset successor: %s\n", fmt.Sprint(n.ID), fmt.Sprint(id), fmt.Sprint(result.ID))
 		more = true
 	}
 	return result, more, nil
 }
 
-func (n *ChordNode) ProcessOrderlyLeave(jsonParsed *gabs.Container) string {
-	leaver, _ := utils.ParseToUInt32(jsonParsed.Path("leaver").String())
-	succ, succ_err := utils.ParseToUInt32(jsonParsed.Path("successor").String())
-	pred, pred_err := utils.ParseToUInt32(jsonParsed.Path("predecessor").String())
+// Does id fall between two consecutive entries of the successor list? Called with mux held.
+func (n *ChordNode) successorListCovers(id utils.ID) (utils.NodeRef, bool) {
+	for i := 1; i < len(n.SuccessorList); i++ {
+		if id == n.SuccessorList[i].ID || utils.IsBetween(n.SuccessorList[i-1].ID, n.SuccessorList[i].ID, id) {
+			return n.SuccessorList[i], true
+		}
+	}
+	return utils.NodeRef{}, false
+}
 
-	if n.Successor != nil && (*(n.Successor) == leaver) && (succ_err == nil) {
+func (n *ChordNode) ProcessOrderlyLeave(leaver utils.ID, predecessor *utils.NodeRef, successor *utils.NodeRef) string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.Successor != nil && (n.Successor.ID == leaver) && (successor != nil) {
+		succ := *successor
 		// Replace n's successor (since it's leaving) with the leaving node's successor.
-		n.mux.Lock()
-		*(n.Successor) = succ
-		n.mux.Unlock()
+		n.Successor = refTo(succ)
+		list := []utils.NodeRef{succ}
+		for _, node := range n.SuccessorList {
+			if node.ID != leaver && node.ID != succ.ID {
+				list = append(list, node)
+			}
+		}
+		n.SuccessorList = list
 		return "Successor updated with Leaver's successor"
-	} else if (n.Predecessor != nil && *(n.Predecessor) == leaver) && (pred_err == nil){
+	} else if (n.Predecessor != nil && n.Predecessor.ID == leaver) && (predecessor != nil){
 		// Replace n's predecessor (since it's leaving) with the leaving node's predecessor.
-		n.mux.Lock()
-		*(n.Predecessor) = pred
-		n.mux.Unlock()
+		n.Predecessor = copyRef(predecessor)
 		return "Precessor updated with Leaver's successor"
 	}
 	return "No changes made"
 }
 
-func (n *ChordNode) FindRingPredecessor() string {
-	if (n.Predecessor != nil) {
-		return fmt.Sprint(*(n.Predecessor))
-	} else {
-		return "No Predecessor"
+func (n *ChordNode) FindRingPredecessor() *utils.PredecessorReply {
+	reply := utils.PredecessorReply{}
+	if predecessor := n.predecessor(); predecessor != nil {
+		reply.ID = new(utils.ID)
+		*(reply.ID) = predecessor.ID
+		reply.Address = predecessor.Address
 	}
+	return &reply
 }
 
 func (n *ChordNode) CheckPredecessor() {
-	if n.Predecessor != nil {
-		cmd := utils.PingCommand()
-		pred_address := (*n.Directory)[*(n.Predecessor)]
-		_, err := utils.SendMessage(cmd, pred_address)
-		if err != nil {
-			n.Predecessor = nil
+	if predecessor := n.predecessor(); predecessor != nil {
+		_, err := n.send(&utils.PingRequest{}, predecessor.Address)
+		if err != nil && n.PeerState(predecessor.Address) == PEER_DEAD {
+			dead := predecessor.ID
+			n.mux.Lock()
+			// A new predecessor may have notified us while we waited.
+			replaced := n.Predecessor == nil || n.Predecessor.ID != dead
+			if !replaced {
+				n.Predecessor = nil
+			}
+			n.mux.Unlock()
+			// We now own the failed predecessor's keys.
+			if !replaced {
+				if promoted := n.promoteReplicas(dead); len(promoted) > 0 {
+					n.replicateChange(promoted, nil)
+				}
+			}
 		}
 	}
 }
 
-func (n ChordNode) Put(key string, value string) (string, error) {
-	//replyTo := msg.Path("reply-to").String()
-	id := utils.ComputeId(key)
-	var targetNode uint32
-	for {
-		var more bool
-		targetNode, more, _ = n.FindRingSuccessor(id)
-		id = targetNode
-		if !more {break;}
-	}
-	// Should we store it on this node?
-	if targetNode == n.ID {
-		n.Data[key] = value
-		fmt.Printf("Storing key '%s' with value '%s' at hash %d on this node, %d", key, value, id, n.ID)
-	} else {
-		fmt.Printf("Sending key '%s' with value '%s' to be stored on %d at hash %d", key, value, targetNode, id)
-		request := utils.PutCommand(key, value, n.Address)
-		reply, err := utils.SendMessage(request, (*n.Directory)[targetNode])
-		return reply, err
+// Move the replicas held for owner into this node's Data. Returns the items
+// promoted.
+func (n *ChordNode) promoteReplicas(owner utils.ID) map[string]string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	items, present := n.Replicas[owner]
+	if !present {
+		return nil
+	}
+	for k, v := range items {
+		n.Data[k] = v
 	}
-	return "", errors.New("error") //TODO: implement
+	delete(n.Replicas, owner)
+	utils.Debug("[Replication: %s] Promoted %s replicas of %s\n", fmt.Sprint(n.ID), fmt.Sprint(len(items)), fmt.Sprint(owner))
+	return items
 }
 
-func (n ChordNode) Get(key string) string {
-	return ""
+// Promote the replicas of every owner between pred and this node. Those owners
+// must have failed, since pred is now our immediate predecessor.
+func (n *ChordNode) promoteReplicasAfter(pred utils.ID) {
+	owners := []utils.ID{}
+	n.mux.Lock()
+	for owner := range n.Replicas {
+		if utils.IsBetween(pred, n.ID, owner) {
+			owners = append(owners, owner)
+		}
+	}
+	n.mux.Unlock()
+	// Later owners win where replicas overlap, so go in a fixed order.
+	sort.Slice(owners, func(i, j int) bool { return owners[i].Cmp(owners[j]) < 0 })
+	for _, owner := range owners {
+		n.promoteReplicas(owner)
+	}
 }
 
-func (n ChordNode) Remove(key string) string {
-	return ""
+/*
+Push a copy of this node's Data to its next ReplicationFactor successors. This
+is the full sync run by maintenance; writes in between only send what changed.
+*/
+func (n *ChordNode) ReplicateKeys() string {
+	n.mux.Lock()
+	items := make(map[string]string, len(n.Data))
+	for k, v := range n.Data {
+		items[k] = v
+	}
+	n.mux.Unlock()
 
+	replicated := n.replicate(&utils.ReplicateRequest{Owner: n.ID, Items: items}, utils.FEATURE_REPLICATION)
+	return fmt.Sprintf("Replicated %d keys to %d successors", len(items), replicated)
 }
 
-func (n ChordNode) ListItems() string {
-	return ""
+/*
+Tell our replicas that items were set and removed deleted here. Successors that
+only take full copies catch up at the next ReplicateKeys.
+*/
+func (n *ChordNode) replicateChange(items map[string]string, removed []string) {
+	n.replicate(&utils.ReplicateDeltaRequest{Owner: n.ID, Items: items, Removed: removed}, utils.FEATURE_REPLICA_DELTAS)
+}
 
+// Send m to those of our next ReplicationFactor successors that support
+// feature. Returns how many took it.
+func (n *ChordNode) replicate(m utils.Message, feature string) int {
+	replicated := 0
+	successors := n.successorList()
+	if n.ReplicationFactor < 0 {
+		successors = nil
+	} else if len(successors) > n.ReplicationFactor {
+		successors = successors[:n.ReplicationFactor]
+	}
+	for _, node := range successors {
+		if node.ID == n.ID || !n.peerSupports(node.Address, feature) {
+			continue
+		}
+		_, err := n.send(m, node.Address)
+		if err != nil {
+			utils.Debug("[Replication: %s] Unable to replicate to %s\n", fmt.Sprint(n.ID), fmt.Sprint(node.ID))
+		} else {
+			replicated++
+		}
+	}
+	return replicated
 }
 
-func (n *ChordNode) ProcessIncomingCommand(msg string) (string, error) {
-	jsonParsed, _ := gabs.ParseJSON([]byte(msg))
-	command := jsonParsed.Path("do").Data().(string)
+// Replace the replicas held for owner.
+func (n *ChordNode) StoreReplicas(owner utils.ID, items map[string]string) string {
+	n.mux.Lock()
+	n.Replicas[owner] = items
+	n.mux.Unlock()
+	return fmt.Sprintf("Stored %d replicas of %s", len(items), owner)
+}
 
-	// If a node is not in the ring, simulate a dropped message.
-	switch strings.TrimSpace(command) {
-	case "init-ring-fingers", "check-predecessor", "ring-notify", "notify-orderly-leave", "ping", "stabilize-ring", "fix-ring-fingers", "leave-ring", "get-ring-fingers", "find-ring-successor", "find-ring-predecessor", "put", "get", "remove":
-		if !n.InRing {
-			utils.Debug("[NOT_IN_RING] command: %s | %s is not in the ring.\n", command, fmt.Sprint(n.ID))
-			return "", errors.New("Not in Ring")
+// Apply a change to the replicas held for owner.
+func (n *ChordNode) UpdateReplicas(owner utils.ID, items map[string]string, removed []string) string {
+	n.mux.Lock()
+	replicas, present := n.Replicas[owner]
+	if !present {
+		replicas = map[string]string{}
+		n.Replicas[owner] = replicas
+	}
+	for k, v := range items {
+		replicas[k] = v
+	}
+	for _, k := range removed {
+		delete(replicas, k)
+	}
+	n.mux.Unlock()
+	return fmt.Sprintf("Updated %d and removed %d replicas of %s", len(items), len(removed), owner)
+}
+
+// Read key from this node only, checking its own Data before the replicas it holds.
+func (n *ChordNode) GetReplica(key string) *utils.KeyReply {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if value, present := n.Data[key]; present {
+		return keyResult(utils.STATUS_OK, key, &value)
+	}
+	for _, items := range n.Replicas {
+		if value, present := items[key]; present {
+			return keyResult(utils.STATUS_OK, key, &value)
 		}
 	}
+	return keyResult(utils.STATUS_NOT_FOUND, key, nil)
+}
 
-	switch strings.TrimSpace(command) {
-	case "ping":
-		return "Healthy", nil
-	case "create-ring":
-		return n.CreateRing(jsonParsed), nil
-	case "join-ring":
-		result := n.JoinRing(jsonParsed)
-		return result, nil
-	case "init-ring-fingers":
-		n.InitRingFingers()
-		return "", nil
-	case "fix-ring-fingers":
-		result := n.FixRingFingers()
-		return result, nil
-	case "stabilize-ring":
-		n.StabilizeRing()
-		return "Ring Stabilized", nil
-	case "leave-ring":
-		n.LeaveRing(jsonParsed)
-		return "", nil
-	case "notify-orderly-leave":
-		result := n.ProcessOrderlyLeave(jsonParsed)
-		return result, nil
-	case "ring-notify":
-		id, _ := utils.ParseToUInt32(jsonParsed.Path("id").String())
-		// TODO: i don't think reply to is needed here
-		replyTo := jsonParsed.Path("reply-to").Data().(string)
-		result := n.RingNotify(id, replyTo)
-		return result, nil
-	case "get-ring-fingers":
-		n.GetRingFingers()
-		return "", nil
-	case "check-predecessor":
-		n.CheckPredecessor()
-		return "", nil
-	case "find-ring-successor":
-		id, _ := utils.ParseToUInt32(jsonParsed.Path("id").String())
+// The primary for key did not answer, so ask the nodes that follow it, which
+// hold its replicas.
+func (n *ChordNode) getFromReplicas(key string, owner utils.NodeRef) (*utils.KeyReply, error) {
+	next := owner
+	for i := 0; i < n.ReplicationFactor; i++ {
 		var err error
-		err = nil
-		var result uint32
-		for {
-			var more bool
-			result, more, err = n.FindRingSuccessor(id)
-			id = result
-			if !more { break;}
-			fmt.Printf("=========================================================MORE: %v\n\n", more)
+		next, err = n.FindKeyOwner(next.ID.Add(big.NewInt(1), n.Bits))
+		if err != nil || next.ID == owner.ID {
+			break
+		}
+		if next.ID == n.ID {
+			return n.GetReplica(key), nil
+		}
+		reply, err := n.forwardKey(&utils.GetReplicaRequest{Data: utils.KeyValue{Key: key}}, next.Address)
+		if err == nil {
+			return reply, nil
+		}
+	}
+	return nil, errors.New("No replica answered for key " + key)
+}
+
+// Locate the node responsible for id. The local finger table is consulted first
+// and, if the answer lies further around the ring, the closest preceding node is asked.
+func (n *ChordNode) FindKeyOwner(id utils.ID) (utils.NodeRef, error) {
+	reply, err := n.Lookup(id, n.LookupMode)
+	if err != nil {
+		return utils.NodeRef{}, err
+	}
+	return reply.Node(), nil
+}
+
+// Lookups give up after this many nodes, in case stale fingers send them round in circles.
+const MAX_LOOKUP_HOPS = 64
+
+// Find the node responsible for id, and the path the lookup took to it.
+func (n *ChordNode) Lookup(id utils.ID, mode string) (*utils.FindRingSuccessorReply, error) {
+	if n.Owns(id) {
+		return lookupReply(n.self(), []utils.NodeRef{n.self()}), nil
+	}
+	request := &utils.FindRingSuccessorRequest{ID: id, ReplyTo: n.GetOwnAddress(), Mode: mode}
+	reply, err := n.handleLookup(request)
+	for err == nil && reply.Next != nil {
+		request.Path = reply.Path
+		reply, err = n.forwardLookup(request, *(reply.Next))
+	}
+	return reply, err
+}
+
+// Our part in a lookup: answer it if we can, otherwise pass it on to the closest
+// node we know of before the id or, if it is iterative, tell the sender to.
+func (n *ChordNode) handleLookup(request *utils.FindRingSuccessorRequest) (*utils.FindRingSuccessorReply, error) {
+	path := append(append([]utils.NodeRef{}, request.Path...), n.self())
+	if len(path) > MAX_LOOKUP_HOPS {
+		return nil, fmt.Errorf("Lookup for %s passed through %d nodes", request.ID, MAX_LOOKUP_HOPS)
+	}
+	result, more, err := n.FindRingSuccessor(request.ID, request.ReplyTo)
+	if err != nil {
+		return nil, err
+	}
+	if !more {
+		return lookupReply(result, path), nil
+	}
+	// No finger precedes id, so it falls to our successor.
+	if result.ID == n.ID {
+		successor := n.successor()
+		if successor == nil {
+			return nil, errors.New("No successor")
 		}
+		return lookupReply(*successor, path), nil
+	}
+	if request.Mode == utils.LOOKUP_ITERATIVE {
+		return &utils.FindRingSuccessorReply{Path: path, Hops: len(path) - 1, Next: &result}, nil
+	}
+	forward := *request
+	forward.Path = path
+	return n.forwardLookup(&forward, result)
+}
+
+func lookupReply(node utils.NodeRef, path []utils.NodeRef) *utils.FindRingSuccessorReply {
+	return &utils.FindRingSuccessorReply{ID: node.ID, Address: node.Address, Path: path, Hops: len(path) - 1}
+}
 
+// Send a lookup to next. If next does not answer, fall back to the last
+// successor list entry that precedes the id.
+func (n *ChordNode) forwardLookup(request *utils.FindRingSuccessorRequest, next utils.NodeRef) (*utils.FindRingSuccessorReply, error) {
+	id := request.ID
+	response, err := n.send(request, next.Address)
+	if err != nil {
+		successors := n.successorList()
+		for i := len(successors) - 1; i >= 0; i-- {
+			succ := successors[i]
+			if succ.ID == next.ID || !utils.IsBetween(n.ID, id, succ.ID) {
+				continue
+			}
+			response, err = n.send(request, succ.Address)
+			if err == nil {
+				break
+			}
+		}
 		if err != nil {
-			return "", err
-		} else {
-			jsonObj := gabs.New()
-			jsonObj.Set(result, "id")
-			return jsonObj.String(), nil
+			return nil, err
 		}
-	case "find-ring-predecessor":
-		// TODO: I don't think this needs any arguments.
-		// AFAICT, a node will send this message to its successor to get the successor's
-		// predecessor.
-		result := n.FindRingPredecessor()
-		return result, nil
-	case "put":
-		key := jsonParsed.Path("data").Path("key").Data().(string)
-		value := jsonParsed.Path("data").Path("value").Data().(string)
-		var result string
-		n.Put(key, value)
-		replyTo := jsonParsed.Path("reply-to").Data().(string)
-		jsonObj := gabs.New()
-		jsonObj.Set(result, "result")
-		result, err := utils.SendMessage(jsonObj.String(), replyTo)
-		return result, err
-	case "get":
-		key := jsonParsed.Path("data").Path("key").Data().(string)
-		result := n.Get(key)
-		replyTo := jsonParsed.Path("reply-to").Data().(string)
-		jsonObj := gabs.New()
-		jsonObj.Set(result, "result")
-		result, err := utils.SendMessage(jsonObj.String(), replyTo)
-		return result, err
-	case "remove":
-		key := jsonParsed.Path("data").Path("key").Data().(string)
-		result := n.Remove(key)
-		replyTo := jsonParsed.Path("reply-to").Data().(string)
-		jsonObj := gabs.New()
-		jsonObj.Set(result, "result")
-		result, err := utils.SendMessage(jsonObj.String(), replyTo)
-		return result, err
-	case "list-items":
-		result := n.ListItems()
-		replyTo := jsonParsed.Path("reply-to").Data().(string)
-		jsonObj := gabs.New()
-		jsonObj.Set(result, "result")
-		result, err := utils.SendMessage(jsonObj.String(), replyTo)
-		return result, err
-	default:
-		return "Invalid command received", errors.New("invalid command")
 	}
+	var reply utils.FindRingSuccessorReply
+	err = utils.DecodeReply(response, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
 }
 
-func (n *ChordNode) Run() {
-	context, _ := zmq.NewContext()
-	defer context.Term()
+// Is this node responsible for id, i.e. is id in (predecessor, n]?
+func (n *ChordNode) Owns(id utils.ID) bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.owns(id)
+}
 
-	socket, _ := context.NewSocket(zmq.ROUTER)
-	defer socket.Close()
-	socket.Bind(fmt.Sprintf("tcp://%s:%d", n.Address, n.Port))
+// As Owns, with mux held.
+func (n *ChordNode) owns(id utils.ID) bool {
+	if id == n.ID {
+		return true
+	}
+	return n.Predecessor != nil && utils.IsBetween(n.Predecessor.ID, n.ID, id)
+}
 
-	dealer, _ := zmq.NewSocket(zmq.DEALER)
-	defer dealer.Close()
-	dealer.Bind(fmt.Sprintf("inproc://%d", n.ID))
+// Whether id is our predecessor, or a node we would take as one. Called with mux held.
+func (n *ChordNode) precededBy(id utils.ID) bool {
+	if id == n.ID {
+		return false
+	}
+	return n.Predecessor == nil || n.Predecessor.ID == id || utils.IsBetween(n.Predecessor.ID, n.ID, id)
+}
 
-	for i := 0; i < 8; i++ {
-		utils.Debug("[ChordRun: %s] worker threads spawned\n", fmt.Sprint(n.ID))
-		go n.ChordWorker()
+// Route a request for key to its owner. Returns the owner, and false if that is
+// this node.
+func (n *ChordNode) routeKey(key string) (utils.NodeRef, bool, error) {
+	owner, err := n.FindKeyOwner(utils.ComputeId(key, n.Bits))
+	if err != nil {
+		return utils.NodeRef{}, false, err
 	}
-	utils.Debug("[ChordRun: %s] Client bound to port %s\n", fmt.Sprint(n.ID), fmt.Sprint(n.Port))
+	return owner, owner.ID != n.ID, nil
+}
+
+func keyResult(status string, key string, value *string) *utils.KeyReply {
+	return &utils.KeyReply{Status: status, Key: key, Value: value}
+}
 
-	err := zmq.Proxy(socket, dealer, nil)
+// Send a key request to the node that owns the key and return its answer.
+func (n *ChordNode) forwardKey(m utils.Message, address string) (*utils.KeyReply, error) {
+	response, err := n.send(m, address)
+	if err != nil {
+		return nil, err
+	}
+	var reply utils.KeyReply
+	err = utils.DecodeReply(response, &reply)
 	if err != nil {
-		utils.Debug("[ChordRun: %s] Proxy dropped\n", fmt.Sprint(n.ID))
+		return nil, err
 	}
+	return &reply, nil
 }
 
-func (n *ChordNode) ChordWorker() {
-	worker,  _ := zmq.NewSocket(zmq.DEALER)
-	defer worker.Close()
-	worker.Connect(fmt.Sprintf("inproc://%d", n.ID))
+// Store value under key on the node responsible for it.
+func (n *ChordNode) Put(key string, value string) (*utils.KeyReply, error) {
+	n.waitForHandoff(key)
+	owner, remote, err := n.routeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if remote {
+		utils.Debug("[Put: %s] Sending key '%s' to %s\n", fmt.Sprint(n.ID), key, owner.Address)
+		return n.forwardKey(&utils.PutRequest{Data: utils.KeyValue{Key: key, Value: value}}, owner.Address)
+	}
+	if !n.lockForWrite(key) {
+		return n.Put(key, value)
+	}
+	n.Data[key] = value
+	if n.joinWrites != nil {
+		n.joinWrites[key] = true
+	}
+	// Routed here on a view of the ring older than our predecessor's; send it on.
+	stray := n.strays(key)
+	n.mux.Unlock()
+	utils.Debug("[Put: %s] Stored key '%s'\n", fmt.Sprint(n.ID), key)
+	if stray {
+		n.startKeyMigration()
+	}
+	n.replicateChange(map[string]string{key: value}, nil)
+	return keyResult(utils.STATUS_OK, key, &value), nil
+}
 
-	utils.Debug("[ChordRun: %s] Worker thread loop starting\n", fmt.Sprint(n.ID))
-	for {
-		msg, err := worker.RecvMessage(0)
-		id, content, err := utils.Pop(msg)
+// Fetch the value stored under key from the node responsible for it.
+func (n *ChordNode) Get(key string) (*utils.KeyReply, error) {
+	n.waitForHandoff(key)
+	owner, remote, err := n.routeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if remote {
+		reply, err := n.forwardKey(&utils.GetRequest{Data: utils.KeyValue{Key: key}}, owner.Address)
+		if err == nil {
+			return reply, nil
+		}
+		utils.Debug("[Get: %s] Owner %s did not answer, trying replicas\n", fmt.Sprint(n.ID), fmt.Sprint(owner.ID))
+		return n.getFromReplicas(key, owner)
+	}
+	n.mux.Lock()
+	value, present := n.Data[key]
+	n.mux.Unlock()
+	if !present {
+		return keyResult(utils.STATUS_NOT_FOUND, key, nil), nil
+	}
+	return keyResult(utils.STATUS_OK, key, &value), nil
+}
 
-		if err != nil {
-			utils.Debug("[chordRun: %s] worker errord\n", fmt.Sprint(n.ID))
-		} else {
-			utils.Debug("[chordRun: %s] worker received: %s\n", fmt.Sprint(n.ID), (string)(content[0]))
-			reply, err := n.ProcessIncomingCommand(content[0])
-			if err != nil {
-				utils.Debug("[ChordRun: %s] Sending Error msg: %s\n", fmt.Sprint(n.ID), err.Error())
-				worker.SendMessage(id, utils.ERROR_MSG)
-			} else {
-				utils.Debug("[ChordRun: %s] Sending msg: %s\n", fmt.Sprint(n.ID), reply)
-				worker.SendMessage(id, reply)
-				utils.Debug("[ChordRun: %s] message sent\n", fmt.Sprint(n.ID))
+// Delete key from the node responsible for it.
+func (n *ChordNode) Remove(key string) (*utils.KeyReply, error) {
+	n.waitForHandoff(key)
+	owner, remote, err := n.routeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if remote {
+		return n.forwardKey(&utils.RemoveRequest{Data: utils.KeyValue{Key: key}}, owner.Address)
+	}
+	if !n.lockForWrite(key) {
+		return n.Remove(key)
+	}
+	value, present := n.Data[key]
+	delete(n.Data, key)
+	if n.joinWrites != nil {
+		n.joinWrites[key] = true
+	}
+	n.mux.Unlock()
+	if !present {
+		return keyResult(utils.STATUS_NOT_FOUND, key, nil), nil
+	}
+	n.replicateChange(nil, []string{key})
+	return keyResult(utils.STATUS_OK, key, &value), nil
+}
+
+// List the items stored on this node.
+func (n *ChordNode) ListItems() *utils.ItemsReply {
+	reply := utils.ItemsReply{Status: utils.STATUS_OK, Items: map[string]string{}}
+	n.mux.Lock()
+	for k, v := range n.Data {
+		reply.Items[k] = v
+	}
+	n.mux.Unlock()
+	return &reply
+}
+
+// Describe this node for the controller.
+func (n *ChordNode) Info() *utils.NodeInfoReply {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	info := utils.NodeInfoReply{
+		ID:            n.ID,
+		Address:       n.Address,
+		Port:          n.Port,
+		InRing:        n.InRing,
+		Predecessor:   copyRef(n.Predecessor),
+		Successor:     copyRef(n.Successor),
+		SuccessorList: append([]utils.NodeRef{}, n.SuccessorList...),
+		Data:          map[string]string{},
+		Bits:          n.Bits,
+		Virtual:       n.Virtual,
+	}
+	if n.host != nil && len(n.host.Nodes) > 1 {
+		info.VirtualNodes = len(n.host.Nodes)
+	}
+	for _, finger := range n.Table {
+		info.Table = append(info.Table, copyRef(finger))
+	}
+	for k, v := range n.Data {
+		info.Data[k] = v
+	}
+	neighbours := append([]utils.NodeRef{}, n.SuccessorList...)
+	if n.Predecessor != nil {
+		neighbours = append(neighbours, *n.Predecessor)
+	}
+	for _, finger := range n.Table {
+		if finger != nil {
+			neighbours = append(neighbours, *finger)
+		}
+	}
+	for _, neighbour := range neighbours {
+		if state := n.PeerState(neighbour.Address); state != PEER_ALIVE {
+			if info.Suspects == nil {
+				info.Suspects = map[string]string{}
 			}
+			info.Suspects[neighbour.Address] = state
 		}
+	}
+	if faults := n.Faults(); faults.Drop > 0 || faults.LatencyMs > 0 || len(faults.Partition) > 0 || faults.Corrupt > 0 || faults.Crash {
+		info.Faults = &faults
+	}
+	return &info
+}
+
 
+
+/*
+Exchange versions and features with the node at address, caching the result.
+Fails if we share no protocol version or id space, and for HELLO_RETRY_INTERVAL
+after any failure. The request that needed the handshake tells the detector
+whether the peer is up, so the handshake does not count as a second miss.
+*/
+func (n *ChordNode) Handshake(address string) (*PeerInfo, error) {
+	n.mux.Lock()
+	info, present := n.peers[address]
+	failed, recent := n.failedHellos[address]
+	n.mux.Unlock()
+	if present {
+		return info, nil
+	}
+	if recent && n.Clock.Now().Sub(failed.at) < HELLO_RETRY_INTERVAL {
+		return nil, failed.err
+	}
+	info, err := n.hello(address)
+	n.mux.Lock()
+	if err != nil {
+		n.failedHellos[address] = failedHello{err: err, at: n.Clock.Now()}
+	} else {
+		delete(n.failedHellos, address)
+		n.peers[address] = info
 	}
+	n.mux.Unlock()
+	return info, err
 }
 
-func (n ChordNode) AddNodeToDirectory() {
-	(*n.Directory)[n.ID] = fmt.Sprintf("tcp://%s:%d", n.Address, n.Port)
+func (n *ChordNode) hello(address string) (*PeerInfo, error) {
+	msg, err := n.Codec.Encode(&utils.HelloRequest{Versions: utils.SupportedVersions(), Features: utils.Features, Bits: n.Bits})
+	if err != nil {
+		return nil, err
+	}
+	response, err := n.transmit(msg, address)
+	if err != nil {
+		return nil, err
+	}
+	info := &PeerInfo{Version: 1, Features: map[string]bool{}, Bits: utils.DEFAULT_BITS}
+	var reply utils.HelloReply
+	err = utils.DecodeReply(response, &reply)
+	if msgErr, ok := err.(*utils.MessageError); ok && msgErr.Code == utils.ERR_UNKNOWN_COMMAND {
+		// The peer predates hello, so it speaks version 1 with no optional features.
+	} else if err != nil {
+		return nil, err
+	} else {
+		info.Version = reply.Version
+		for _, feature := range reply.Features {
+			info.Features[feature] = true
+		}
+		if reply.Bits != 0 {
+			info.Bits = reply.Bits
+		}
+	}
+	if info.Bits != n.Bits {
+		return nil, fmt.Errorf("%s uses %d-bit ids, we use %d", address, info.Bits, n.Bits)
+	}
+	return info, nil
 }
 
-func GetAddress(directory map[uint32]string, id string) string {
-	uid, _ := strconv.ParseUint(id, 10, 32)
-	uid32 := uint32(uid)
-	return directory[uid32]
+// Does the node at address support feature? Unreachable peers are assumed to,
+// since the request itself will then fail.
+func (n *ChordNode) peerSupports(address string, feature string) bool {
+	info, err := n.Handshake(address)
+	if err != nil {
+		return true
+	}
+	return info.Features[feature]
 }
 
-func (n ChordNode) GetSocketAddress() (string, bool) {
-	address, present := (*n.Directory)[n.ID]
-	return address, present
+func (n *ChordNode) ProcessIncomingCommand(msg string) (reply string, err error) {
+	// Answer in the format the request came in, so a JSON client can talk to a binary node.
+	codec := utils.CodecOf(msg)
+
+	// A bug in a handler should cost one request, not the worker.
+	defer func() {
+		if r := recover(); r != nil {
+			utils.Debug("[ProcessIncomingCommand: %s] recovered: %s\n", fmt.Sprint(n.ID), fmt.Sprint(r))
+			reply, err = codec.EncodeReply(utils.ErrorReply(utils.ERR_INTERNAL, fmt.Sprint(r)))
+		}
+	}()
+
+	request, err := codec.Decode(msg)
+	if err != nil {
+		utils.Debug("[ProcessIncomingCommand: %s] rejected message: %s\n", fmt.Sprint(n.ID), err.Error())
+		decodeErr := err.(*utils.MessageError)
+		return codec.EncodeReply(utils.ErrorReply(decodeErr.Code, decodeErr.Message))
+	}
+
+	// Fault rules can always be changed, even to bring a crashed node back.
+	_, control := request.(*utils.SetFaultsRequest)
+	if !control {
+		if err := n.refuse(); err != nil {
+			utils.Debug("[FAULT] command: %s | %s: %s\n", request.Command(), fmt.Sprint(n.ID), err.Error())
+			return "", err
+		}
+	}
+
+	// If a node is not in the ring, simulate a dropped message.
+	switch request.(type) {
+	case *utils.CreateRingRequest, *utils.JoinRingRequest, *utils.HelloRequest, *utils.NodeInfoRequest, *utils.SetFaultsRequest:
+	default:
+		if !n.IsInRing() {
+			utils.Debug("[NOT_IN_RING] command: %s | %s is not in the ring.\n", request.Command(), fmt.Sprint(n.ID))
+			return "", errors.New("Not in Ring")
+		}
+	}
+
+	result, err := n.handle(request)
+	if err != nil {
+		return "", err
+	}
+	reply, err = codec.EncodeReply(result)
+	if err != nil {
+		utils.Debug("[ProcessIncomingCommand: %s] cannot encode reply: %s\n", fmt.Sprint(n.ID), err.Error())
+		return codec.EncodeReply(utils.ErrorReply(utils.ERR_INTERNAL, err.Error()))
+	}
+	if control {
+		return reply, nil
+	}
+	return n.afflict(reply), nil
+}
+
+// Carry out a decoded request and return the reply to send back.
+func (n *ChordNode) handle(request utils.Message) (interface{}, error) {
+	switch m := request.(type) {
+	case *utils.PingRequest:
+		return utils.OkReply("Healthy"), nil
+	case *utils.HelloRequest:
+		reply, err := utils.NegotiateHello(m)
+		if err != nil {
+			return utils.ErrorReply(utils.ERR_UNSUPPORTED_VERSION, err.(*utils.MessageError).Message), nil
+		}
+		if m.Bits != 0 && m.Bits != n.Bits {
+			return utils.ErrorReply(utils.ERR_INVALID, fmt.Sprintf("this ring uses %d-bit ids, not %d", n.Bits, m.Bits)), nil
+		}
+		reply.Bits = n.Bits
+		return reply, nil
+	case *utils.CreateRingRequest:
+		return n.CreateRing(), nil
+	case *utils.JoinRingRequest:
+		return n.JoinRing(m.SponsoringNode), nil
+	case *utils.InitRingFingersRequest:
+		return utils.OkReply(n.InitRingFingers()), nil
+	case *utils.FixRingFingersRequest:
+		return utils.OkReply(n.FixRingFingers()), nil
+	case *utils.StabilizeRingRequest:
+		return utils.OkReply(n.StabilizeRing()), nil
+	case *utils.LeaveRingRequest:
+		return n.LeaveRing(m.Mode), nil
+	case *utils.NotifyOrderlyLeaveRequest:
+		predecessor, successor := m.Neighbours()
+		return utils.OkReply(n.ProcessOrderlyLeave(m.Leaver, predecessor, successor)), nil
+	case *utils.RingNotifyRequest:
+		return utils.OkReply(n.RingNotify(m.ID, m.ReplyTo)), nil
+	case *utils.GetRingFingersRequest:
+		return n.GetRingFingers(), nil
+	case *utils.CheckPredecessorRequest:
+		n.CheckPredecessor()
+		return utils.OkReply(""), nil
+	case *utils.FindRingSuccessorRequest:
+		return n.handleLookup(m)
+	case *utils.FindRingPredecessorRequest:
+		// AFAICT, a node will send this message to its successor to get the successor's
+		// predecessor.
+		return n.FindRingPredecessor(), nil
+	case *utils.PutRequest:
+		return n.Put(m.Data.Key, m.Data.Value)
+	case *utils.GetRequest:
+		return n.Get(m.Data.Key)
+	case *utils.RemoveRequest:
+		return n.Remove(m.Data.Key)
+	case *utils.ListItemsRequest:
+		return n.ListItems(), nil
+	case *utils.ReplicateKeysRequest:
+		return utils.OkReply(n.ReplicateKeys()), nil
+	case *utils.ReplicateRequest:
+		return utils.OkReply(n.StoreReplicas(m.Owner, m.Items)), nil
+	case *utils.ReplicateDeltaRequest:
+		return utils.OkReply(n.UpdateReplicas(m.Owner, m.Items, m.Removed)), nil
+	case *utils.BulkPutRequest:
+		reply, err := n.BulkPut(m.From, m.Items)
+		if err != nil {
+			return utils.ErrorReply(utils.ERR_INVALID, err.Error()), nil
+		}
+		return reply, nil
+	case *utils.TransferKeysRequest:
+		accepted, err := n.AcceptKeys(m.From, m.Items)
+		if err != nil {
+			return utils.ErrorReply(utils.ERR_INVALID, err.Error()), nil
+		}
+		return utils.OkReply(accepted), nil
+	case *utils.GetSuccessorListRequest:
+		return n.GetSuccessorList(), nil
+	case *utils.GetReplicaRequest:
+		return n.GetReplica(m.Data.Key), nil
+	case *utils.SetFaultsRequest:
+		if err := n.SetFaults(m.Faults); err != nil {
+			return utils.ErrorReply(utils.ERR_INVALID, err.Error()), nil
+		}
+		return utils.OkReply("Faults set"), nil
+	case *utils.NodeInfoRequest:
+		return n.Info(), nil
+	default:
+		return utils.ErrorReply(utils.ERR_UNKNOWN_COMMAND, "unhandled command "+request.Command()), nil
+	}
+}
+
+/*
+Serve requests and run the maintenance tasks in the background until ctx is done
+or Stop is called.
+*/
+func (n *ChordNode) Start(ctx context.Context) error {
+	if n.host != nil {
+		return errors.New("Virtual nodes are started by their host")
+	}
+	n.mux.Lock()
+	if n.stopped != nil {
+		n.mux.Unlock()
+		return errors.New("Node is already running")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	n.cancel = cancel
+	n.stopped = stopped
+	n.serveErr = nil
+	n.mux.Unlock()
+
+	utils.Debug("[ChordRun: %s] Serving on %s\n", fmt.Sprint(n.ID), n.GetOwnAddress())
+	n.startMaintenance()
+	go func() {
+		err := n.Transport.Serve(ctx, n.GetOwnAddress(), n.ProcessIncomingCommand)
+		cancel()
+		n.StopMaintenance()
+		if err != nil {
+			utils.Debug("[ChordRun: %s] Transport stopped: %s\n", fmt.Sprint(n.ID), err.Error())
+		}
+		n.mux.Lock()
+		n.serveErr = err
+		n.mux.Unlock()
+		close(stopped)
+	}()
+	return nil
+}
+
+/*
+Stop accepting requests, answer the ones already accepted, then close the
+node's sockets and wait for its workers and maintenance tasks to exit. Gives up
+waiting once ctx is done. The node does not leave its ring; send leave-ring first.
+*/
+func (n *ChordNode) Stop(ctx context.Context) error {
+	n.mux.Lock()
+	cancel, stopped := n.cancel, n.stopped
+	n.mux.Unlock()
+	if stopped == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.stopped == stopped {
+		n.stopped = nil
+		n.cancel = nil
+	}
+	return n.serveErr
+}
+
+// Block until the node stops, returning the error that stopped its transport, if any.
+func (n *ChordNode) Wait() error {
+	n.mux.Lock()
+	stopped := n.stopped
+	n.mux.Unlock()
+	if stopped == nil {
+		return nil
+	}
+	<-stopped
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.serveErr
+}
+
+// Serve until the node is stopped.
+func (n *ChordNode) Run() {
+	err := n.Start(context.Background())
+	if err != nil {
+		utils.Debug("[ChordRun: %s] %s\n", fmt.Sprint(n.ID), err.Error())
+		return
+	}
+	n.Wait()
 }
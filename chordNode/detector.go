@@ -0,0 +1,281 @@
+package chordnode
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// What a node believes about a peer.
+const (
+	PEER_ALIVE	= "alive"
+	PEER_SUSPECT	= "suspect" // Recently failed to answer. Kept, but not relied on.
+	PEER_DEAD	= "dead" // Given up on. Dropped from successors, predecessor and fingers.
+)
+
+/*
+Judges from normal traffic whether peers are up. A node tells its detector
+about every reply it gets and every request that fails, so one lost message or
+slow reply need not cost a peer its place in the ring. Implementations must be
+safe for concurrent use, and should not hold on to peers no one has mentioned
+for DETECTOR_MEMORY.
+*/
+type FailureDetector interface {
+	Heard(address string, at time.Time) // A reply came back from address.
+	Missed(address string, at time.Time) // A request to address got no usable reply.
+	State(address string, at time.Time) string // PEER_ALIVE, PEER_SUSPECT or PEER_DEAD.
+	Forget(address string)
+}
+
+/*
+How long a detector keeps what it knows of a peer it has heard nothing about,
+neither a reply nor a failed request. Neighbours and fingers are sent to far
+more often, so such a peer is no longer one, and forgetting it keeps the
+detector from growing with every address the node has ever talked to.
+*/
+const DETECTOR_MEMORY = 5 * time.Minute
+
+// Default thresholds for StrikesDetector.
+const DEFAULT_SUSPECT_STRIKES = 1
+const DEFAULT_DEAD_STRIKES = 3
+
+/*
+Counts the requests in a row a peer has failed to answer. Suspect after
+Suspect of them, dead after Dead. Any reply clears the count.
+*/
+type StrikesDetector struct {
+	Suspect	int
+	Dead	int
+	mux	sync.Mutex
+	strikes	map[string]*strikes
+	pruned	time.Time
+}
+
+type strikes struct {
+	count	int
+	last	time.Time // When the last request failed.
+}
+
+func NewStrikesDetector(suspect int, dead int) *StrikesDetector {
+	return &StrikesDetector{Suspect: suspect, Dead: dead, strikes: map[string]*strikes{}}
+}
+
+func (d *StrikesDetector) Heard(address string, at time.Time) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	delete(d.strikes, address)
+	d.prune(at)
+}
+
+func (d *StrikesDetector) Missed(address string, at time.Time) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	peer, present := d.strikes[address]
+	if !present {
+		peer = &strikes{}
+		d.strikes[address] = peer
+	}
+	peer.count++
+	peer.last = at
+	d.prune(at)
+}
+
+func (d *StrikesDetector) State(address string, at time.Time) string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.prune(at)
+	peer, present := d.strikes[address]
+	if !present {
+		return PEER_ALIVE
+	}
+	if peer.count >= d.Dead {
+		return PEER_DEAD
+	}
+	if peer.count >= d.Suspect {
+		return PEER_SUSPECT
+	}
+	return PEER_ALIVE
+}
+
+// Drop peers whose last failure is older than DETECTOR_MEMORY, at most once
+// per DETECTOR_MEMORY. Called with mux held.
+func (d *StrikesDetector) prune(at time.Time) {
+	if at.Sub(d.pruned) < DETECTOR_MEMORY {
+		return
+	}
+	for address, peer := range d.strikes {
+		if at.Sub(peer.last) > DETECTOR_MEMORY {
+			delete(d.strikes, address)
+		}
+	}
+	d.pruned = at
+}
+
+// How many peers the detector holds state for.
+func (d *StrikesDetector) Tracked() int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return len(d.strikes)
+}
+
+func (d *StrikesDetector) Forget(address string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	delete(d.strikes, address)
+}
+
+// Default thresholds for PhiDetector.
+const DEFAULT_PHI_SUSPECT = 1.0
+const DEFAULT_PHI_DEAD = 3.0
+
+// Replies a PhiDetector remembers the spacing of, per peer.
+const PHI_WINDOW = 32
+
+/*
+Phi accrual detector. Once a request to a peer fails, phi measures how unlikely
+it is that a peer still up would have stayed silent for as long since, given
+how far apart its replies usually are: phi 1 means a one in ten chance, phi 2
+one in a hundred. The spacing is taken to be exponentially distributed around
+its recent mean. A peer is suspect from phi Suspect and dead from phi Dead.
+Counting from the first failure rather than the last reply means a peer we
+have simply not needed for a while is not condemned by one lost message.
+Until a peer has replied twice, Interval stands in for the mean.
+*/
+type PhiDetector struct {
+	Suspect		float64
+	Dead		float64
+	Interval	time.Duration
+	mux		sync.Mutex
+	peers		map[string]*phiPeer
+	pruned		time.Time
+}
+
+type phiPeer struct {
+	last		time.Time // When it last replied.
+	intervals	[]time.Duration
+	silent		time.Time // When a request first failed since the last reply, or zero.
+	missed		time.Time // When a request last failed.
+}
+
+func NewPhiDetector(suspect float64, dead float64, interval time.Duration) *PhiDetector {
+	return &PhiDetector{Suspect: suspect, Dead: dead, Interval: interval, peers: map[string]*phiPeer{}}
+}
+
+func (d *PhiDetector) Heard(address string, at time.Time) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	defer d.prune(at)
+	peer, present := d.peers[address]
+	if !present {
+		d.peers[address] = &phiPeer{last: at}
+		return
+	}
+	if peer.silent.IsZero() && !peer.last.IsZero() && at.After(peer.last) {
+		peer.intervals = append(peer.intervals, at.Sub(peer.last))
+		if len(peer.intervals) > PHI_WINDOW {
+			peer.intervals = peer.intervals[1:]
+		}
+	}
+	peer.last = at
+	peer.silent = time.Time{}
+}
+
+func (d *PhiDetector) Missed(address string, at time.Time) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	peer, present := d.peers[address]
+	if !present {
+		peer = &phiPeer{}
+		d.peers[address] = peer
+	}
+	if peer.silent.IsZero() {
+		peer.silent = at
+	}
+	peer.missed = at
+	d.prune(at)
+}
+
+// Phi for peer at time at. Called with mux held.
+func (d *PhiDetector) phi(peer *phiPeer, at time.Time) float64 {
+	mean := d.Interval
+	if len(peer.intervals) > 0 {
+		var total time.Duration
+		for _, interval := range peer.intervals {
+			total += interval
+		}
+		mean = total / time.Duration(len(peer.intervals))
+	}
+	if mean <= 0 {
+		mean = time.Millisecond
+	}
+	// -log10 of the chance of a silence at least this long, e^(-elapsed/mean).
+	return float64(at.Sub(peer.silent)) / float64(mean) * math.Log10(math.E)
+}
+
+func (d *PhiDetector) State(address string, at time.Time) string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.prune(at)
+	peer, present := d.peers[address]
+	if !present || peer.silent.IsZero() {
+		return PEER_ALIVE
+	}
+	phi := d.phi(peer, at)
+	if phi >= d.Dead {
+		return PEER_DEAD
+	}
+	if phi >= d.Suspect {
+		return PEER_SUSPECT
+	}
+	return PEER_ALIVE
+}
+
+func (d *PhiDetector) Forget(address string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	delete(d.peers, address)
+}
+
+// Drop peers we have heard nothing about for DETECTOR_MEMORY, at most once
+// per DETECTOR_MEMORY. Called with mux held.
+func (d *PhiDetector) prune(at time.Time) {
+	if at.Sub(d.pruned) < DETECTOR_MEMORY {
+		return
+	}
+	for address, peer := range d.peers {
+		if at.Sub(peer.last) > DETECTOR_MEMORY && at.Sub(peer.missed) > DETECTOR_MEMORY {
+			delete(d.peers, address)
+		}
+	}
+	d.pruned = at
+}
+
+// How many peers the detector holds state for.
+func (d *PhiDetector) Tracked() int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return len(d.peers)
+}
+
+// Names of the detectors, for NewDetector.
+const (
+	DETECT_STRIKES	= "strikes"
+	DETECT_PHI	= "phi"
+)
+
+// Pick one of the detectors by name, with default thresholds.
+func NewDetector(name string) (FailureDetector, error) {
+	switch name {
+	case DETECT_STRIKES:
+		return NewStrikesDetector(DEFAULT_SUSPECT_STRIKES, DEFAULT_DEAD_STRIKES), nil
+	case DETECT_PHI:
+		return NewPhiDetector(DEFAULT_PHI_SUSPECT, DEFAULT_PHI_DEAD, DefaultMaintenance.Stabilize), nil
+	}
+	return nil, errors.New("Unknown failure detector " + name)
+}
+
+// What our detector makes of the peer at address now.
+func (n *ChordNode) PeerState(address string) string {
+	return n.Detector.State(address, n.Clock.Now())
+}
@@ -0,0 +1,111 @@
+package chordnode
+
+import (
+	"chord/utils"
+
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+The faults a node injects, set with SetFaults or a set-faults request. Random
+choices come from a source seeded with the node's id, so a simulated run with
+faults still replays the same way.
+*/
+type faultInjector struct {
+	mux		sync.Mutex
+	rules		utils.FaultRules
+	partition	map[utils.ID]bool
+	rand		*rand.Rand
+}
+
+func (f *faultInjector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.rand.Float64() < p
+}
+
+func (f *faultInjector) get() utils.FaultRules {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.rules
+}
+
+// Replace the faults the node injects. The zero FaultRules clears them.
+func (n *ChordNode) SetFaults(rules utils.FaultRules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	f := &n.faults
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.rand == nil {
+		f.rand = seededRand(n.ID)
+	}
+	f.rules = rules
+	f.partition = map[utils.ID]bool{}
+	for _, id := range rules.Partition {
+		f.partition[id] = true
+	}
+	utils.Debug("[SetFaults: %s] %s\n", n.ID.String(), utils.Encode(&utils.SetFaultsRequest{Faults: rules}))
+	return nil
+}
+
+// A random source seeded with id, so that simulated runs replay the same way.
+func seededRand(id utils.ID) *rand.Rand {
+	seed := fnv.New64a()
+	seed.Write([]byte(id.String()))
+	return rand.New(rand.NewSource(int64(seed.Sum64())))
+}
+
+func (n *ChordNode) Faults() utils.FaultRules {
+	return n.faults.get()
+}
+
+func (n *ChordNode) crashed() bool {
+	return n.faults.get().Crash
+}
+
+// Whether a request we send to address must fail: we have crashed, or its node is on the other side of a partition.
+func (n *ChordNode) unreachable(address string) bool {
+	return n.crashed() || n.partitioned(address)
+}
+
+// Whether our fault rules put the node at address on the other side of a partition.
+func (n *ChordNode) partitioned(address string) bool {
+	f := &n.faults
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.partition[utils.ComputeId(address, n.Bits)]
+}
+
+// Whether to refuse an incoming request rather than handle it.
+func (n *ChordNode) refuse() error {
+	rules := n.faults.get()
+	if rules.Crash {
+		return errors.New("Crashed")
+	}
+	if n.faults.chance(rules.Drop) {
+		return errors.New("Dropped by fault rules")
+	}
+	return nil
+}
+
+// Hold reply back and perhaps garble it, as the rules say.
+func (n *ChordNode) afflict(reply string) string {
+	rules := n.faults.get()
+	if rules.LatencyMs > 0 {
+		n.Clock.Sleep(time.Duration(rules.LatencyMs) * time.Millisecond)
+	}
+	if n.faults.chance(rules.Corrupt) {
+		// Half a reply decodes in neither codec.
+		return reply[:len(reply)/2]
+	}
+	return reply
+}
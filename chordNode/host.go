@@ -0,0 +1,139 @@
+package chordnode
+
+import (
+	"chord/utils"
+
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/*
+A process's share of the ring: several virtual nodes, each with its own id,
+fingers and keys, served from one transport endpoint. Spreading a host over
+several points of the ring evens out the key ranges hosts end up with.
+
+The first virtual node has the host's address, so a host of one behaves like a
+node of its own. See utils.VirtualAddress for the others.
+*/
+type Host struct {
+	Address		string
+	Port		int
+	Transport	utils.Transport
+	Nodes		[]*ChordNode
+	mux		sync.Mutex
+	cancel		context.CancelFunc // Stops the transport started by Start.
+	stopped		chan struct{} // Closed once the host has stopped.
+	serveErr	error
+}
+
+/*
+Returns a new Host with count virtual nodes. A nil transport defaults to ZeroMQ.
+*/
+func NewHost(address string, port int, transport utils.Transport, count int) *Host {
+	if transport == nil {
+		transport = utils.ZmqTransport{}
+	}
+	h := &Host{Address: address, Port: port, Transport: transport}
+	for i := 0; i < count; i++ {
+		n := New(address, port, transport)
+		n.Virtual = i
+		n.ID = utils.ComputeId(n.GetOwnAddress(), n.Bits)
+		n.host = h
+		h.Nodes = append(h.Nodes, n)
+	}
+	return h
+}
+
+func GenerateRandomHost(count int) *Host {
+	return NewHost(utils.Localhost, randomPort(), utils.ZmqTransport{}, count)
+}
+
+func (h *Host) GetOwnAddress() string {
+	return fmt.Sprintf("tcp://%s:%d", h.Address, h.Port)
+}
+
+// Hand a request to the virtual node it is for.
+func (h *Host) ProcessIncomingCommand(msg string) (string, error) {
+	i, msg := utils.UntagVirtual(msg)
+	if i < 0 || i >= len(h.Nodes) {
+		return "", errors.New("No such virtual node")
+	}
+	return h.Nodes[i].ProcessIncomingCommand(msg)
+}
+
+/*
+Serve requests for every virtual node and run their maintenance tasks in the
+background until ctx is done or Stop is called.
+*/
+func (h *Host) Start(ctx context.Context) error {
+	h.mux.Lock()
+	if h.stopped != nil {
+		h.mux.Unlock()
+		return errors.New("Host is already running")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	h.cancel = cancel
+	h.stopped = stopped
+	h.serveErr = nil
+	h.mux.Unlock()
+
+	utils.Debug("[HostRun: %s] Serving %s virtual nodes\n", h.GetOwnAddress(), fmt.Sprint(len(h.Nodes)))
+	for _, n := range h.Nodes {
+		n.startMaintenance()
+	}
+	go func() {
+		err := h.Transport.Serve(ctx, h.GetOwnAddress(), h.ProcessIncomingCommand)
+		cancel()
+		for _, n := range h.Nodes {
+			n.StopMaintenance()
+		}
+		if err != nil {
+			utils.Debug("[HostRun: %s] Transport stopped: %s\n", h.GetOwnAddress(), err.Error())
+		}
+		h.mux.Lock()
+		h.serveErr = err
+		h.mux.Unlock()
+		close(stopped)
+	}()
+	return nil
+}
+
+// Stop serving, waiting until requests already accepted are answered or ctx is done.
+func (h *Host) Stop(ctx context.Context) error {
+	h.mux.Lock()
+	cancel, stopped := h.cancel, h.stopped
+	h.mux.Unlock()
+	if stopped == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.stopped == stopped {
+		h.stopped = nil
+		h.cancel = nil
+	}
+	return h.serveErr
+}
+
+// Block until the host stops, returning the error that stopped its transport, if any.
+func (h *Host) Wait() error {
+	h.mux.Lock()
+	stopped := h.stopped
+	h.mux.Unlock()
+	if stopped == nil {
+		return nil
+	}
+	<-stopped
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.serveErr
+}
@@ -0,0 +1,102 @@
+package chordnode
+
+import (
+	"chord/utils"
+
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/*
+How often a node runs each of its maintenance tasks. A zero interval disables
+the task. Every wait is stretched by a random amount of up to Jitter times the
+interval, so that nodes started together do not stabilize in lockstep.
+*/
+type MaintenanceConfig struct {
+	Stabilize		time.Duration
+	CheckPredecessor	time.Duration
+	FixFingers		time.Duration
+	Replicate		time.Duration
+	Repair			time.Duration // See RepairRing.
+	Jitter			float64
+}
+
+var DefaultMaintenance = MaintenanceConfig{
+	Stabilize:        750 * time.Millisecond,
+	CheckPredecessor: 1500 * time.Millisecond,
+	FixFingers:       1000 * time.Millisecond,
+	Replicate:        2000 * time.Millisecond,
+	Repair:           5000 * time.Millisecond,
+	Jitter:           0.2,
+}
+
+// Start a goroutine for every enabled maintenance task. Called by Start.
+func (n *ChordNode) startMaintenance() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.stopTasks != nil {
+		return
+	}
+	n.stopTasks = make(chan struct{})
+	config := n.Maintenance
+	tasks := []struct {
+		name		string
+		interval	time.Duration
+		run		func() string
+	}{
+		{"Stabilize", config.Stabilize, n.StabilizeRing},
+		{"CheckPredecessor", config.CheckPredecessor, func() string {
+			n.CheckPredecessor()
+			return "Predecessor checked"
+		}},
+		{"FixFingers", config.FixFingers, n.FixRingFingers},
+		{"Replicate", config.Replicate, n.ReplicateKeys},
+		{"Repair", config.Repair, n.RepairRing},
+	}
+	for _, task := range tasks {
+		if task.interval <= 0 {
+			continue
+		}
+		n.tasks.Add(1)
+		go n.every(task.name, task.interval, config.Jitter, n.stopTasks, task.run)
+	}
+}
+
+// Stop the maintenance tasks and wait for any that are running to finish.
+func (n *ChordNode) StopMaintenance() {
+	n.mux.Lock()
+	stop := n.stopTasks
+	n.stopTasks = nil
+	n.mux.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	n.tasks.Wait()
+}
+
+// Run task every interval, plus jitter, while the node is in a ring and has not crashed.
+func (n *ChordNode) every(name string, interval time.Duration, jitter float64, stop chan struct{}, task func() string) {
+	defer n.tasks.Done()
+	timer := time.NewTimer(jittered(interval, jitter))
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		if n.IsInRing() && !n.crashed() {
+			result := task()
+			utils.Debug("[%s: %s] %s\n", name, fmt.Sprint(n.ID), result)
+		}
+		timer.Reset(jittered(interval, jitter))
+	}
+}
+
+func jittered(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Float64()*jitter*float64(interval))
+}
@@ -0,0 +1,138 @@
+package chordnode
+
+import (
+	"chord/utils"
+
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// How a node picks the next hop of a lookup among the fingers and successors
+// that precede the id.
+const ROUTE_PROGRESS = "progress" // The one closest to the id, as in the Chord paper.
+const ROUTE_PROXIMITY = "proximity" // Weigh how far each one gets us against how long it takes to reach.
+
+// Weight of each new sample in a smoothed round trip time, as in TCP.
+const RTT_SMOOTHING = 0.125
+
+/*
+Smoothed round trip times to the peers we have heard back from, by address.
+It has its own lock, so it can be read with the node's mux held.
+*/
+type rttTable struct {
+	mux	sync.Mutex
+	rtts	map[string]time.Duration
+}
+
+func (t *rttTable) observe(address string, sample time.Duration) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.rtts == nil {
+		t.rtts = map[string]time.Duration{}
+	}
+	if rtt, present := t.rtts[address]; present {
+		sample = rtt + time.Duration(RTT_SMOOTHING*float64(sample-rtt))
+	}
+	t.rtts[address] = sample
+}
+
+func (t *rttTable) get(address string) (time.Duration, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	rtt, present := t.rtts[address]
+	return rtt, present
+}
+
+// Average over every peer we know; 0 if we know none.
+func (t *rttTable) mean() time.Duration {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if len(t.rtts) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, rtt := range t.rtts {
+		total += rtt
+	}
+	return total / time.Duration(len(t.rtts))
+}
+
+// Our smoothed round trip time to address, if we have measured it.
+func (n *ChordNode) RTT(address string) (time.Duration, bool) {
+	return n.rtt.get(address)
+}
+
+func (n *ChordNode) SetRouting(routing string) error {
+	if routing != ROUTE_PROGRESS && routing != ROUTE_PROXIMITY {
+		return errors.New("Unknown routing " + routing)
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.Routing = routing
+	return nil
+}
+
+/*
+Only requests the peer answers itself say how far away it is. Anything it may
+pass on, like a recursive lookup, would count the time spent further along.
+*/
+func timed(m utils.Message) bool {
+	switch m := m.(type) {
+	case *utils.PingRequest, *utils.FindRingPredecessorRequest, *utils.GetSuccessorListRequest, *utils.HelloRequest:
+		return true
+	case *utils.FindRingSuccessorRequest:
+		return m.Mode == utils.LOOKUP_ITERATIVE
+	}
+	return false
+}
+
+// Ping node if proximity routing will want to know how far away it is and we don't yet.
+func (n *ChordNode) measure(node utils.NodeRef) {
+	n.mux.Lock()
+	routing := n.Routing
+	n.mux.Unlock()
+	if _, known := n.rtt.get(node.Address); routing != ROUTE_PROXIMITY || known || node.ID == n.ID {
+		return
+	}
+	n.send(&utils.PingRequest{}, node.Address)
+}
+
+/*
+Pick the candidate that should get a lookup for id to its end soonest: the
+round trip to the candidate, plus the mean round trip for every hop still left
+after it. The hops left are the halvings needed to close the candidate's
+distance to id down to the typical gap between nodes, which we estimate from
+our successor list. Peers we have not measured count as average. Called with
+mux held.
+*/
+func (n *ChordNode) nearestCandidate(id utils.ID, candidates []utils.NodeRef) utils.NodeRef {
+	mean := n.rtt.mean()
+	gap := big.NewInt(1)
+	if len(n.SuccessorList) > 0 {
+		last := n.SuccessorList[len(n.SuccessorList)-1]
+		gap = utils.Distance(n.ID, last.ID, n.Bits)
+		gap.Div(gap, big.NewInt(int64(len(n.SuccessorList))))
+	}
+	var best utils.NodeRef
+	var bestCost time.Duration
+	var bestDistance *big.Int
+	for i, candidate := range candidates {
+		distance := utils.Distance(candidate.ID, id, n.Bits)
+		hops := distance.BitLen() - gap.BitLen()
+		if hops < 0 {
+			hops = 0
+		}
+		rtt, known := n.rtt.get(candidate.Address)
+		if !known {
+			rtt = mean
+		}
+		cost := rtt + time.Duration(hops)*mean
+		// Between equals, go further.
+		if i == 0 || cost < bestCost || (cost == bestCost && distance.Cmp(bestDistance) < 0) {
+			best, bestCost, bestDistance = candidate, cost, distance
+		}
+	}
+	return best
+}
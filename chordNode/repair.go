@@ -0,0 +1,135 @@
+package chordnode
+
+import (
+	"chord/utils"
+
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// Most peers a node remembers to check the ring through.
+const MAX_KNOWN_PEERS = 32
+
+/*
+Remember peers we have heard of, to check the ring through later. Peers across
+a partition stay known while they cannot be reached, since once it heals those
+are the ones to join up with. Called with mux held.
+*/
+func (n *ChordNode) remember(peers ...utils.NodeRef) {
+	for _, peer := range peers {
+		if peer.ID == n.ID {
+			continue
+		}
+		if _, present := n.known[peer.Address]; !present && len(n.known) >= MAX_KNOWN_PEERS {
+			delete(n.known, n.randomKnown().Address)
+		}
+		n.known[peer.Address] = peer.ID
+	}
+}
+
+// Whether we remember the peer at address to check the ring through.
+func (n *ChordNode) Knows(address string) bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	_, present := n.known[address]
+	return present
+}
+
+// Whether the peer at address is our successor, on our successor list or a
+// finger. Called with mux held.
+func (n *ChordNode) isNeighbour(address string) bool {
+	if n.Successor != nil && n.Successor.Address == address {
+		return true
+	}
+	for _, node := range n.SuccessorList {
+		if node.Address == address {
+			return true
+		}
+	}
+	for _, node := range n.Table {
+		if node != nil && node.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// A known peer picked at random, or nil if we know none. Called with mux held.
+func (n *ChordNode) randomKnown() *utils.NodeRef {
+	if len(n.known) == 0 {
+		return nil
+	}
+	// Sorted, as map order would make simulated runs differ.
+	addresses := []string{}
+	for address := range n.known {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	if n.rand == nil {
+		n.rand = seededRand(n.ID)
+	}
+	address := addresses[n.rand.Intn(len(addresses))]
+	return &utils.NodeRef{ID: n.known[address], Address: address}
+}
+
+/*
+Look up the id just after ours through a known peer picked at random. After a
+partition heals, the ring can be left as separate loops, each consistent on its
+own; a peer in another loop then knows a closer successor than ours. Adopting
+it lets stabilization stitch the loops back into one ring. Peers that refuse
+the lookup, e.g. because they have left, or that our detector has given up on
+are forgotten, unless our fault rules put them across a partition. The detector
+forgets refusing peers too, except successors and fingers: a crashed node also
+refuses, and stabilization must go on seeing it dead.
+*/
+func (n *ChordNode) RepairRing() string {
+	n.mux.Lock()
+	peer := n.randomKnown()
+	n.mux.Unlock()
+	if peer == nil {
+		return "No known peers to check the ring through"
+	}
+	request := &utils.FindRingSuccessorRequest{ID: n.ID.Add(big.NewInt(1), n.Bits), ReplyTo: n.GetOwnAddress()}
+	response, err := n.send(request, peer.Address)
+	var reply utils.FindRingSuccessorReply
+	if err == nil {
+		err = n.decodeReply(peer.Address, response, &reply)
+	}
+	if err != nil {
+		refused := errors.Is(err, utils.ErrDropped)
+		if refused || (n.PeerState(peer.Address) == PEER_DEAD && !n.partitioned(peer.Address)) {
+			n.mux.Lock()
+			delete(n.known, peer.Address)
+			if refused && !n.isNeighbour(peer.Address) {
+				n.Detector.Forget(peer.Address)
+			}
+			n.mux.Unlock()
+		}
+		return fmt.Sprintf("Could not check the ring through %s", peer.ID)
+	}
+	found := utils.NodeRef{ID: reply.ID, Address: reply.Address}
+	// The peer may not know that found has stopped answering, and we may not
+	// know that it has come back, so ask it before trusting either of us.
+	if found.ID != n.ID && n.PeerState(found.Address) == PEER_DEAD {
+		n.send(&utils.PingRequest{}, found.Address)
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.remember(reply.Path...)
+	if !n.InRing || n.Successor == nil || found.ID == n.ID || found.ID == n.Successor.ID {
+		return fmt.Sprintf("Ring checked through %s", peer.ID)
+	}
+	if n.PeerState(found.Address) == PEER_DEAD {
+		return fmt.Sprintf("Ring checked through %s, which knows of %s, but it is dead", peer.ID, found.ID)
+	}
+	// A lone node takes anyone.
+	if n.Successor.ID != n.ID && !utils.IsBetween(n.ID, n.Successor.ID, found.ID) {
+		return fmt.Sprintf("Ring checked through %s", peer.ID)
+	}
+	n.adoptSuccessor(found)
+	n.remember(found)
+	return fmt.Sprintf("Found closer successor %s through %s", found.ID, peer.ID)
+}
@@ -2,88 +2,1829 @@ package main
 
 import (
 	chordnode "chord/chordNode"
+	"chord/sim"
 	"chord/utils"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Jeffail/gabs"
 )
 
+// The rings in these tests are big enough that debug output would drown the failures.
+func TestMain(m *testing.M) {
+	utils.DEBUG = false
+	os.Exit(m.Run())
+}
+
 func TestCreateRing(t *testing.T) {
-	nodeDirectory := map[uint32]string{}
-	node1 := chordnode.GenerateRandomNode(&nodeDirectory)
-	node1.AddNodeToDirectory()
+	node1 := chordnode.GenerateRandomNode()
 
 	go node1.Run()
 
-	sourceAddress, _ := node1.GetSocketAddress()
+	sourceAddress := node1.GetOwnAddress()
 	createCommand := utils.CreateRingCommand()
 	fmt.Println(createCommand)
-	reply := utils.SendMessage(createCommand, sourceAddress)
+	reply, _ := utils.SendMessage(createCommand, sourceAddress)
 	jsonParsed, _ := gabs.ParseJSON([]byte(reply))
 	status, _ := strconv.Unquote(jsonParsed.Path("status").String())
-	fmt.Println("InRing - expected: true actual:", node1.InRing)
+	fmt.Println("InRing - expected: true actual:", node1.IsInRing())
 	if strings.Compare(status, "ok") != 0 {
 		t.Errorf("status = %s", status)
 	}
 }
 
 func TestJoinRing(t *testing.T) {
-	nodeDirectory := map[uint32]string{}
-	node1 := chordnode.GenerateRandomNode(&nodeDirectory)
-	node2 := chordnode.GenerateRandomNode(&nodeDirectory)
-	node1.AddNodeToDirectory()
-	node2.AddNodeToDirectory()
+	node1 := chordnode.GenerateRandomNode()
+	node2 := chordnode.GenerateRandomNode()
 
 	go node1.Run()
 	go node2.Run()
 
-	sourceAddress, _ := node1.GetSocketAddress()
+	sourceAddress := node1.GetOwnAddress()
 	joinCommand := utils.JoinRingCommand(sourceAddress)
 	fmt.Println(joinCommand)
-	destAddress, _ := node2.GetSocketAddress()
-	reply := utils.SendMessage(joinCommand, destAddress)
+	destAddress := node2.GetOwnAddress()
+	reply, _ := utils.SendMessage(joinCommand, destAddress)
 	jsonParsed, _ := gabs.ParseJSON([]byte(reply))
 	status, _ := strconv.Unquote(jsonParsed.Path("status").String())
-	fmt.Println("InRing - expected: true actual:", node2.InRing)
+	fmt.Println("InRing - expected: true actual:", node2.IsInRing())
 	if strings.Compare(status, "ok") != 0 {
 		t.Errorf("status = %s", status)
 	}
 }
 
 func TestLeaveRing(t *testing.T) {
-	nodeDirectory := map[uint32]string{}
-	node1 := chordnode.GenerateRandomNode(&nodeDirectory)
-	node2 := chordnode.GenerateRandomNode(&nodeDirectory)
-	node1.AddNodeToDirectory()
-	node2.AddNodeToDirectory()
+	node1 := chordnode.GenerateRandomNode()
+	node2 := chordnode.GenerateRandomNode()
 
 	go node1.Run()
 	go node2.Run()
 
-	sourceAddress, _ := node1.GetSocketAddress()
+	sourceAddress := node1.GetOwnAddress()
 	joinCommand := utils.JoinRingCommand(sourceAddress)
 	fmt.Println(joinCommand)
-	destAddress, _ := node2.GetSocketAddress()
+	destAddress := node2.GetOwnAddress()
 	utils.SendMessage(joinCommand, destAddress)
 
 	leaveCommandI := utils.LeaveRingCommand("immediately")
 	leaveCommandO := utils.LeaveRingCommand("orderly")
-	reply := utils.SendMessage(leaveCommandI, destAddress)
+	reply, _ := utils.SendMessage(leaveCommandI, destAddress)
 	jsonParsed, _ := gabs.ParseJSON([]byte(reply))
 	status, _ := strconv.Unquote(jsonParsed.Path("status").String())
-	fmt.Println("InRing - expected: false actual:", node2.InRing)
+	fmt.Println("InRing - expected: false actual:", node2.IsInRing())
 	if strings.Compare(status, "ok") != 0 {
 		t.Errorf("status = %s", status)
 	}
 
-	reply = utils.SendMessage(leaveCommandO, sourceAddress)
+	reply, _ = utils.SendMessage(leaveCommandO, sourceAddress)
 	jsonParsed, _ = gabs.ParseJSON([]byte(reply))
 	status, _ = strconv.Unquote(jsonParsed.Path("status").String())
-	fmt.Println("InRing - expected: false actual:", node1.InRing)
+	fmt.Println("InRing - expected: false actual:", node1.IsInRing())
 	if strings.Compare(status, "ok") != 0 {
 		t.Errorf("status = %s", status)
 	}
 }
+
+// Sends msg until the node answers, to ride out the node's transport starting up.
+func sendUntilAnswered(t *testing.T, transport utils.Transport, msg string, address string) string {
+	reply, err := sendUntilAnsweredErr(transport, msg, address)
+	if err != nil {
+		t.Fatalf("no reply from %s", address)
+	}
+	return reply
+}
+
+func sendUntilAnsweredErr(transport utils.Transport, msg string, address string) (string, error) {
+	var err error
+	for i := 0; i < 1000; i++ {
+		var reply string
+		reply, err = transport.SendMessage(msg, address)
+		if err == nil {
+			return reply, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return "", err
+}
+
+func TestMemoryTransportRing(t *testing.T) {
+	const count = 200
+	transport := utils.NewMemoryTransport()
+	nodes := []*chordnode.ChordNode{}
+	for i := 0; i < count; i++ {
+		node := chordnode.New(utils.Localhost, utils.MinPort+i, transport)
+		// Mix codecs, since nodes must understand each other whichever they use.
+		if i%2 == 1 {
+			node.Codec = utils.Binary
+		}
+		// Stabilization is driven by the test.
+		node.Maintenance = chordnode.MaintenanceConfig{}
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes {
+		go node.Run()
+	}
+
+	sourceAddress := nodes[0].GetOwnAddress()
+	sendUntilAnswered(t, transport, utils.CreateRingCommand(), sourceAddress)
+	for _, node := range nodes[1:] {
+		sendUntilAnswered(t, transport, utils.JoinRingCommand(sourceAddress), node.GetOwnAddress())
+	}
+
+	if !stabilize(transport, nodes, count) {
+		t.Errorf("ring of %d nodes did not converge", count)
+	}
+}
+
+// Each node's successor in a correct ring of nodes.
+func ringSuccessors(nodes []*chordnode.ChordNode) map[utils.ID]utils.ID {
+	ids := []utils.ID{}
+	for _, node := range nodes {
+		ids = append(ids, node.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Cmp(ids[j]) < 0 })
+	expected := map[utils.ID]utils.ID{}
+	for i, id := range ids {
+		expected[id] = ids[(i+1)%len(ids)]
+	}
+	return expected
+}
+
+func converged(nodes []*chordnode.ChordNode) bool {
+	expected := ringSuccessors(nodes)
+	for _, node := range nodes {
+		if successor := node.Info().Successor; successor == nil || successor.ID != expected[node.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+// Send stabilize-ring to every node until the ring converges or rounds run out.
+func stabilize(transport utils.Transport, nodes []*chordnode.ChordNode, rounds int) bool {
+	for round := 0; round < rounds && !converged(nodes); round++ {
+		for _, node := range nodes {
+			transport.SendMessage(utils.StabilizeRingCommand(), node.GetOwnAddress())
+		}
+	}
+	return converged(nodes)
+}
+
+// A stable ring of count nodes over memory, with every finger fixed. configure,
+// if given, can set each node up before it starts.
+func fingeredRing(t *testing.T, count int, configure func(node *chordnode.ChordNode)) (*utils.MemoryTransport, []*chordnode.ChordNode) {
+	transport := utils.NewMemoryTransport()
+	nodes := []*chordnode.ChordNode{}
+	for i := 0; i < count; i++ {
+		node := chordnode.New(utils.Localhost, utils.MinPort+i, transport)
+		node.Maintenance = chordnode.MaintenanceConfig{}
+		if configure != nil {
+			configure(node)
+		}
+		nodes = append(nodes, node)
+		go node.Run()
+	}
+	sourceAddress := nodes[0].GetOwnAddress()
+	sendUntilAnswered(t, transport, utils.CreateRingCommand(), sourceAddress)
+	for _, node := range nodes[1:] {
+		sendUntilAnswered(t, transport, utils.JoinRingCommand(sourceAddress), node.GetOwnAddress())
+	}
+	if !stabilize(transport, nodes, count) {
+		t.Fatalf("ring of %d nodes did not converge", count)
+	}
+	// Successor lists catch up a round behind successors, and lookups trust them.
+	for round := 0; round < chordnode.DEFAULT_SUCCESSOR_LIST_SIZE; round++ {
+		for _, node := range nodes {
+			transport.SendMessage(utils.StabilizeRingCommand(), node.GetOwnAddress())
+		}
+	}
+	for _, node := range nodes {
+		for i := 0; i < node.Bits; i++ {
+			transport.SendMessage(utils.FixRingFingersCommand(), node.GetOwnAddress())
+		}
+	}
+	return transport, nodes
+}
+
+// The first of nodes at or after id, worked out the slow way.
+func successorIn(nodes []*chordnode.ChordNode, id utils.ID) utils.ID {
+	ids := []utils.ID{}
+	for _, node := range nodes {
+		ids = append(ids, node.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Cmp(ids[j]) < 0 })
+	for _, candidate := range ids {
+		if candidate.Cmp(id) >= 0 {
+			return candidate
+		}
+	}
+	return ids[0]
+}
+
+// Fail the test with every way in which the ring made of nodes is wrong.
+func checkRing(t *testing.T, nodes []*chordnode.ChordNode) *utils.RingReport {
+	t.Helper()
+	infos := []*utils.NodeInfoReply{}
+	for _, node := range nodes {
+		infos = append(infos, node.Info())
+	}
+	report := utils.CheckRing(infos)
+	for _, violation := range report.Violations {
+		t.Errorf("%s", violation)
+	}
+	return report
+}
+
+// Send a key command to the node at address and decode its answer.
+func keyCommand(t *testing.T, transport utils.Transport, msg string, address string) utils.KeyReply {
+	t.Helper()
+	var reply utils.KeyReply
+	if err := utils.DecodeReply(sendUntilAnswered(t, transport, msg, address), &reply); err != nil {
+		t.Fatalf("%s: %s", msg, err.Error())
+	}
+	return reply
+}
+
+// Keys are stored, read and removed through any node, and missing keys say so.
+func TestKeyValueCommands(t *testing.T) {
+	transport, nodes := fingeredRing(t, 4, nil)
+	for _, msg := range []string{utils.GetCommand("missing"), utils.RemoveCommand("missing")} {
+		if reply := keyCommand(t, transport, msg, nodes[0].GetOwnAddress()); reply.Status != utils.STATUS_NOT_FOUND || reply.Value != nil {
+			t.Errorf("%s: %+v, want not found", msg, reply)
+		}
+	}
+	keyCommand(t, transport, utils.PutCommand("key", "value"), nodes[1].GetOwnAddress())
+	if reply := keyCommand(t, transport, utils.GetCommand("key"), nodes[2].GetOwnAddress()); reply.Status != utils.STATUS_OK || reply.Value == nil || *reply.Value != "value" {
+		t.Errorf("get after put: %+v", reply)
+	}
+	if reply := keyCommand(t, transport, utils.RemoveCommand("key"), nodes[3].GetOwnAddress()); reply.Status != utils.STATUS_OK || reply.Value == nil || *reply.Value != "value" {
+		t.Errorf("remove after put: %+v", reply)
+	}
+	if reply := keyCommand(t, transport, utils.GetCommand("key"), nodes[0].GetOwnAddress()); reply.Status != utils.STATUS_NOT_FOUND {
+		t.Errorf("get after remove: %+v", reply)
+	}
+}
+
+/*
+When a key's owner dies, reads fall back to the replicas on its successors, and
+the successor that notices promotes them to keys of its own.
+*/
+func TestReplicaPromotion(t *testing.T) {
+	transport, nodes := fingeredRing(t, 6, nil)
+	sorted := sortedByID(nodes)
+	owner, heir, reader := sorted[2], sorted[3], sorted[5]
+	// A key that owner is responsible for.
+	key := ""
+	for k := 0; key == ""; k++ {
+		if successorIn(nodes, utils.ComputeId(fmt.Sprint("key-", k), owner.Bits)) == owner.ID {
+			key = fmt.Sprint("key-", k)
+		}
+	}
+	keyCommand(t, transport, utils.PutCommand(key, "value"), reader.GetOwnAddress())
+	if reply := heir.GetReplica(key); reply.Status != utils.STATUS_OK {
+		t.Fatalf("%s was not replicated to the owner's successor", key)
+	}
+
+	owner.SetFaults(utils.FaultRules{Crash: true})
+	if reply := keyCommand(t, transport, utils.GetCommand(key), reader.GetOwnAddress()); reply.Status != utils.STATUS_OK || *reply.Value != "value" {
+		t.Errorf("read with the owner down: %+v", reply)
+	}
+	for i := 0; i < chordnode.DEFAULT_DEAD_STRIKES; i++ {
+		heir.CheckPredecessor()
+	}
+	if _, present := heir.ListItems().Items[key]; !present {
+		t.Errorf("%s was not promoted when its owner died", key)
+	}
+
+	// A negative factor replicates to no one rather than failing.
+	heir.ReplicationFactor = -1
+	if reply := heir.ReplicateKeys(); !strings.Contains(reply, "to 0 successors") {
+		t.Errorf("replicating with a negative factor: %s", reply)
+	}
+}
+
+// A node whose successor dies moves on to the next node in its successor list.
+func TestSuccessorListFailover(t *testing.T) {
+	_, nodes := fingeredRing(t, 6, nil)
+	sorted := sortedByID(nodes)
+	node, dead, next := sorted[1], sorted[2], sorted[3]
+	if list := node.GetSuccessorList().Successors; len(list) != chordnode.DEFAULT_SUCCESSOR_LIST_SIZE || list[0] != dead.ID || list[1] != next.ID {
+		t.Fatalf("successor list %v, want %s, %s, ...", list, dead.ID, next.ID)
+	}
+	dead.SetFaults(utils.FaultRules{Crash: true})
+	for i := 0; i < chordnode.DEFAULT_DEAD_STRIKES; i++ {
+		node.StabilizeRing()
+	}
+	if successor := node.Info().Successor; successor == nil || successor.ID != next.ID {
+		t.Errorf("successor %v after %s died, want %s", successor, dead.ID, next.ID)
+	}
+	if list := node.GetSuccessorList().Successors; len(list) == 0 || list[0] != next.ID {
+		t.Errorf("successor list %v still starts with the dead node", list)
+	}
+}
+
+/*
+Keys written while a joining node takes its keys over from its successor land
+on the new owner, and none are overwritten by the copies in transit.
+*/
+func TestJoinKeyTransfer(t *testing.T) {
+	const keys = 200
+	transport, nodes := fingeredRing(t, 4, nil)
+	for k := 0; k < keys; k++ {
+		keyCommand(t, transport, utils.PutCommand(fmt.Sprint("key-", k), "old"), nodes[0].GetOwnAddress())
+	}
+	joiner := chordnode.New(utils.Localhost, utils.MinPort+len(nodes), transport)
+	joiner.Maintenance = chordnode.MaintenanceConfig{}
+	go joiner.Run()
+
+	var writers sync.WaitGroup
+	for w, node := range nodes {
+		writers.Add(1)
+		go func(w int, address string) {
+			defer writers.Done()
+			for k := w; k < keys; k += len(nodes) {
+				reply, err := transport.SendMessage(utils.PutCommand(fmt.Sprint("key-", k), "new"), address)
+				var put utils.KeyReply
+				if err == nil {
+					err = utils.DecodeReply(reply, &put)
+				}
+				if err != nil || put.Status != utils.STATUS_OK {
+					t.Errorf("put key-%d during the join: %v %+v", k, err, put)
+				}
+			}
+		}(w, node.GetOwnAddress())
+	}
+	sendUntilAnswered(t, transport, utils.JoinRingCommand(nodes[0].GetOwnAddress()), joiner.GetOwnAddress())
+	all := append(nodes, joiner)
+	stabilize(transport, all, len(all))
+	writers.Wait()
+	if !stabilize(transport, all, len(all)) {
+		t.Fatalf("ring did not converge after the join")
+	}
+
+	// The last transfers finish in the background.
+	deadline := time.Now().Add(2 * time.Second)
+	for k := 0; k < keys; k++ {
+		key := fmt.Sprint("key-", k)
+		reply := keyCommand(t, transport, utils.GetCommand(key), nodes[k%len(nodes)].GetOwnAddress())
+		for (reply.Status != utils.STATUS_OK || *reply.Value != "new") && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			reply = keyCommand(t, transport, utils.GetCommand(key), nodes[k%len(nodes)].GetOwnAddress())
+		}
+		if reply.Status != utils.STATUS_OK || *reply.Value != "new" {
+			t.Errorf("%s = %+v, want the write made during the join", key, reply)
+		}
+	}
+	if len(joiner.ListItems().Items) == 0 {
+		t.Errorf("no keys were transferred to the new node")
+	}
+}
+
+/*
+Hands messages on to Transport, recording the size of each bulk-put sent, and
+answers hello as a peer without batching if Old is set.
+*/
+type handOffTransport struct {
+	utils.Transport
+	Old		bool
+	mux		sync.Mutex // Guards chunks.
+	chunks		[]int
+}
+
+func (t *handOffTransport) SendMessage(msg string, address string) (string, error) {
+	return t.SendMessageContext(context.Background(), msg, address)
+}
+
+func (t *handOffTransport) SendMessageContext(ctx context.Context, msg string, address string) (string, error) {
+	m, _ := utils.CodecOf(msg).Decode(msg)
+	switch m := m.(type) {
+	case *utils.HelloRequest:
+		if t.Old {
+			return utils.EncodeReply(&utils.HelloReply{Version: utils.PROTOCOL_VERSION, Features: []string{utils.FEATURE_REPLICATION}}), nil
+		}
+	case *utils.BulkPutRequest:
+		t.mux.Lock()
+		t.chunks = append(t.chunks, len(m.Items))
+		t.mux.Unlock()
+	}
+	return t.Transport.SendMessageContext(ctx, msg, address)
+}
+
+// nodes in ring order, starting from the lowest id.
+func sortedByID(nodes []*chordnode.ChordNode) []*chordnode.ChordNode {
+	sorted := append([]*chordnode.ChordNode{}, nodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID.Cmp(sorted[j].ID) < 0 })
+	return sorted
+}
+
+// Keys whose owner in nodes is owner, made up until there are count of them.
+func keysOwnedBy(nodes []*chordnode.ChordNode, owner *chordnode.ChordNode, count int) map[string]string {
+	items := map[string]string{}
+	for k := 0; len(items) < count; k++ {
+		key := fmt.Sprint("key-", k)
+		if successorIn(nodes, utils.ComputeId(key, owner.Bits)) == owner.ID {
+			items[key] = fmt.Sprint("value-", k)
+		}
+	}
+	return items
+}
+
+/*
+A node leaving in an orderly way hands its keys to its successor in chunks, and
+stays in the ring if the successor cannot take them in bulk. A bulk-put is only
+taken by the node that owns the keys, or is about to.
+*/
+func TestOrderlyLeave(t *testing.T) {
+	// The first node around the ring sees its peers as old ones, from its first hello on.
+	first := chordnode.New(utils.Localhost, utils.MinPort, nil).ID
+	for i := 1; i < 5; i++ {
+		if id := chordnode.New(utils.Localhost, utils.MinPort+i, nil).ID; id.Cmp(first) < 0 {
+			first = id
+		}
+	}
+	transports := map[string]*handOffTransport{}
+	transport, nodes := fingeredRing(t, 5, func(node *chordnode.ChordNode) {
+		wrapped := &handOffTransport{Transport: node.Transport, Old: node.ID == first}
+		transports[node.GetOwnAddress()] = wrapped
+		node.Transport = wrapped
+	})
+	sorted := sortedByID(nodes)
+	stuck, leaver, heir, stranger := sorted[0], sorted[1], sorted[2], sorted[4]
+	readable := func(items map[string]string) {
+		t.Helper()
+		for key, value := range items {
+			if reply := keyCommand(t, transport, utils.GetCommand(key), stranger.GetOwnAddress()); reply.Status != utils.STATUS_OK || *reply.Value != value {
+				t.Errorf("%s = %+v, want %s", key, reply, value)
+			}
+		}
+	}
+
+	// bulk-put answers with the number of keys taken, and refuses keys that are
+	// not the receiver's to store.
+	items := keysOwnedBy(nodes, leaver, 2*chordnode.BULK_PUT_CHUNK_SIZE+1)
+	var count utils.CountReply
+	utils.DecodeReply(sendUntilAnswered(t, transport, utils.BulkPutCommand(stuck.ID, items), leaver.GetOwnAddress()), &count)
+	if count.Status != utils.STATUS_OK || count.Count != len(items) {
+		t.Errorf("bulk-put of %d keys to their owner: %+v", len(items), count)
+	}
+	misplaced := keysOwnedBy(nodes, heir, 1)
+	err := utils.DecodeReply(sendUntilAnswered(t, transport, utils.BulkPutCommand(stuck.ID, misplaced), stranger.GetOwnAddress()), &count)
+	if msgErr, ok := err.(*utils.MessageError); !ok || msgErr.Code != utils.ERR_INVALID {
+		t.Errorf("bulk-put to a node that does not own the keys: %v", err)
+	}
+	for key := range misplaced {
+		if _, present := stranger.ListItems().Items[key]; present {
+			t.Errorf("misplaced %s was stored", key)
+		}
+	}
+
+	// A successor without batching would have the keys routed back to us.
+	stuckItems := keysOwnedBy(nodes, stuck, 8)
+	for key, value := range stuckItems {
+		keyCommand(t, transport, utils.PutCommand(key, value), stranger.GetOwnAddress())
+	}
+	var status utils.StatusReply
+	utils.DecodeReply(sendUntilAnswered(t, transport, utils.LeaveRingCommand("orderly"), stuck.GetOwnAddress()), &status)
+	if status.Status == utils.STATUS_OK || !stuck.IsInRing() {
+		t.Errorf("left with keys for a successor without batching: %+v", status)
+	}
+	readable(stuckItems)
+
+	utils.DecodeReply(sendUntilAnswered(t, transport, utils.LeaveRingCommand("orderly"), leaver.GetOwnAddress()), &status)
+	if status.Status != utils.STATUS_OK || leaver.IsInRing() {
+		t.Fatalf("orderly leave: %+v", status)
+	}
+	chunks := transports[leaver.GetOwnAddress()].chunks
+	if len(chunks) != 3 || chunks[0] != chordnode.BULK_PUT_CHUNK_SIZE || chunks[2] != 1 {
+		t.Errorf("handed %d keys off in chunks of %v", len(items), chunks)
+	}
+	if len(heir.ListItems().Items) < len(items) {
+		t.Errorf("successor has %d keys after taking %d", len(heir.ListItems().Items), len(items))
+	}
+	remaining := []*chordnode.ChordNode{stuck, heir, sorted[3], stranger}
+	stabilize(transport, remaining, len(remaining))
+	for _, node := range remaining {
+		for i := 0; i < node.Bits; i++ {
+			transport.SendMessage(utils.FixRingFingersCommand(), node.GetOwnAddress())
+		}
+	}
+	readable(items)
+}
+
+// A node whose successor has crashed hands its keys to the next one instead.
+func TestOrderlyLeaveAfterCrash(t *testing.T) {
+	transport, nodes := fingeredRing(t, 5, nil)
+	sorted := sortedByID(nodes)
+	leaver, crashed, heir, reader := sorted[1], sorted[2], sorted[3], sorted[4]
+	items := keysOwnedBy(nodes, leaver, 4)
+	for key, value := range items {
+		keyCommand(t, transport, utils.PutCommand(key, value), reader.GetOwnAddress())
+	}
+
+	crashed.SetFaults(utils.FaultRules{Crash: true})
+	for i := 0; i < chordnode.DEFAULT_DEAD_STRIKES; i++ {
+		heir.CheckPredecessor()
+	}
+	var status utils.StatusReply
+	utils.DecodeReply(sendUntilAnswered(t, transport, utils.LeaveRingCommand("orderly"), leaver.GetOwnAddress()), &status)
+	if status.Status != utils.STATUS_OK || leaver.IsInRing() {
+		t.Fatalf("orderly leave past a crashed successor: %+v", status)
+	}
+	for key, value := range items {
+		if stored, present := heir.ListItems().Items[key]; !present || stored != value {
+			t.Errorf("%s = %q on the next successor, want %s", key, stored, value)
+		}
+	}
+}
+
+func TestFingerTables(t *testing.T) {
+	transport, nodes := fingeredRing(t, 32, nil)
+	for _, node := range nodes {
+		reply := sendUntilAnswered(t, transport, utils.GetRingFingersCommand(), node.GetOwnAddress())
+		var fingers utils.FingersReply
+		if err := utils.DecodeReply(reply, &fingers); err != nil || len(fingers.Fingers) != node.Bits {
+			t.Fatalf("get-ring-fingers from %s = %s", node.ID, reply)
+		}
+		for i, finger := range fingers.Fingers {
+			if want := utils.FingerStart(node.ID, i, node.Bits); finger.Start != want {
+				t.Errorf("node %s finger %d starts at %s, want %s", node.ID, i, finger.Start, want)
+			}
+			if want := successorIn(nodes, finger.Start); finger.Node == nil || finger.Node.ID != want {
+				t.Errorf("node %s finger %d = %v, want %s", node.ID, i, finger.Node, want)
+			}
+		}
+	}
+}
+
+// A settled ring passes the check, and each way of breaking it is reported against the node at fault.
+func TestRingCheck(t *testing.T) {
+	_, nodes := fingeredRing(t, 16, nil)
+	for k := 0; k < 32; k++ {
+		key := fmt.Sprint("key-", k)
+		if reply, err := nodes[k%len(nodes)].Put(key, key); err != nil || reply.Status != utils.STATUS_OK {
+			t.Fatalf("put %s: %v %v", key, reply, err)
+		}
+	}
+	if report := checkRing(t, nodes); !report.OK || report.Nodes != 16 || report.Keys != 32 {
+		t.Fatalf("settled ring: %+v", report)
+	}
+
+	infos := []*utils.NodeInfoReply{}
+	for _, node := range nodes {
+		infos = append(infos, node.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID.Cmp(infos[j].ID) < 0 })
+	first, second, third := infos[0], infos[1], infos[2]
+	first.Successor = &utils.NodeRef{ID: third.ID, Address: third.Address}
+	second.Predecessor = nil
+	second.Table[0] = nil
+	moved := ""
+	for key, value := range second.Data {
+		moved = key
+		third.Data[key] = value
+		delete(second.Data, key)
+		break
+	}
+	if moved == "" {
+		t.Fatalf("node %s has no keys to move", second.ID)
+	}
+	// Leaving the ring removes a node from what the others should point at.
+	infos[len(infos)-1].InRing = false
+
+	report := utils.CheckRing(infos)
+	want := map[string]utils.ID{
+		utils.CHECK_SUCCESSOR:   first.ID,
+		utils.CHECK_PREDECESSOR: second.ID,
+		utils.CHECK_FINGER:      second.ID,
+		utils.CHECK_KEY:         third.ID,
+	}
+	found := map[string]bool{}
+	for _, violation := range report.Violations {
+		if violation.Node == want[violation.Check] {
+			found[violation.Check] = true
+		}
+	}
+	for check, node := range want {
+		if !found[check] {
+			t.Errorf("no %s violation reported for node %s in %v", check, node, report.Violations)
+		}
+	}
+	if report.OK || report.Nodes != 15 {
+		t.Errorf("broken ring: ok=%t nodes=%d", report.OK, report.Nodes)
+	}
+}
+
+/*
+Each fault rule shows up at the sender, a crash is noticed by CheckPredecessor
+and stabilization, and the ring heals around the node and then takes it back.
+*/
+func TestFaultInjection(t *testing.T) {
+	transport, nodes := fingeredRing(t, 8, nil)
+	sorted := sortedByID(nodes)
+	victim, next := sorted[3], sorted[4]
+	others := append(append([]*chordnode.ChordNode{}, sorted[:3]...), sorted[4:]...)
+	set := func(faults utils.FaultRules) {
+		t.Helper()
+		if reply := sendUntilAnswered(t, transport, utils.SetFaultsCommand(faults), victim.GetOwnAddress()); !strings.Contains(reply, "Faults set") {
+			t.Fatalf("set-faults %+v = %s", faults, reply)
+		}
+	}
+	ping := func() (string, time.Duration, error) {
+		start := time.Now()
+		reply, err := transport.SendMessage(utils.PingCommand(), victim.GetOwnAddress())
+		return reply, time.Since(start), err
+	}
+	// Check predecessors, stabilize and fix fingers until group is a ring again.
+	// Successor lists lag a round behind successors, so keep on after they converge.
+	repair := func(group []*chordnode.ChordNode) {
+		t.Helper()
+		for round := 0; round < len(group); round++ {
+			for _, node := range group {
+				transport.SendMessage(utils.CheckPredecessorCommand(), node.GetOwnAddress())
+				transport.SendMessage(utils.StabilizeRingCommand(), node.GetOwnAddress())
+			}
+		}
+		for _, node := range group {
+			for i := 0; i < node.Bits; i++ {
+				transport.SendMessage(utils.FixRingFingersCommand(), node.GetOwnAddress())
+			}
+		}
+		checkRing(t, group)
+	}
+
+	set(utils.FaultRules{Drop: 1})
+	if _, _, err := ping(); !errors.Is(err, utils.ErrDropped) {
+		t.Errorf("ping with every request dropped: %v", err)
+	}
+	set(utils.FaultRules{LatencyMs: 30})
+	if _, took, err := ping(); err != nil || took < 30*time.Millisecond {
+		t.Errorf("ping with 30ms latency took %s: %v", took, err)
+	}
+	set(utils.FaultRules{Corrupt: 1})
+	if reply, _, err := ping(); err == nil && utils.DecodeReply(reply, &utils.StatusReply{}) == nil {
+		t.Errorf("corrupted reply %q decoded", reply)
+	}
+
+	// Cut off from its successor, the victim suspects it at first, then gives up
+	// on it and skips it, but the successor still hears from others.
+	set(utils.FaultRules{Partition: []utils.ID{next.ID}})
+	victim.StabilizeRing()
+	if state := victim.PeerState(next.GetOwnAddress()); state != chordnode.PEER_SUSPECT {
+		t.Errorf("successor is %s after one missed request, want suspect", state)
+	}
+	if successor := victim.Info().Successor; successor == nil || successor.ID != next.ID {
+		t.Errorf("successor dropped after one missed request: %v", successor)
+	}
+	for i := 1; i < chordnode.DEFAULT_DEAD_STRIKES; i++ {
+		victim.StabilizeRing()
+	}
+	if successor := victim.Info().Successor; successor == nil || successor.ID == next.ID {
+		t.Errorf("successor across a partition: %v", successor)
+	}
+	if _, err := transport.SendMessage(utils.PingCommand(), next.GetOwnAddress()); err != nil {
+		t.Errorf("ping %s from outside the partition: %s", next.ID, err)
+	}
+	set(utils.FaultRules{})
+	repair(nodes)
+
+	set(utils.FaultRules{Crash: true})
+	if info := victim.Info(); info.Faults == nil || !info.Faults.Crash {
+		t.Errorf("node-info does not report the crash: %+v", info.Faults)
+	}
+	repair(others)
+	set(utils.FaultRules{})
+	repair(nodes)
+}
+
+/*
+Both detectors move a peer from alive to suspect to dead as it stays silent,
+and back on its next reply. In a ring, a peer that misses one request keeps its
+place as successor and predecessor.
+*/
+func TestFailureDetectors(t *testing.T) {
+	const peer = "tcp://127.0.0.1:9999"
+	start := time.Unix(0, 0)
+	at := func(seconds float64) time.Time {
+		return start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	strikes := chordnode.NewStrikesDetector(1, 3)
+	phi := chordnode.NewPhiDetector(1, 3, time.Second)
+	for i := 0; i <= 4; i++ {
+		strikes.Heard(peer, at(float64(i)))
+		phi.Heard(peer, at(float64(i)))
+	}
+	// Replies a second apart, then silence from 5s: phi reaches 1 after 2.3s and 3 after 6.9s.
+	steps := []struct {
+		seconds		float64
+		strikes, phi	string
+	}{
+		{5, chordnode.PEER_SUSPECT, chordnode.PEER_ALIVE},
+		{6, chordnode.PEER_SUSPECT, chordnode.PEER_ALIVE},
+		{8, chordnode.PEER_DEAD, chordnode.PEER_SUSPECT},
+		{12, chordnode.PEER_DEAD, chordnode.PEER_DEAD},
+	}
+	for _, step := range steps {
+		strikes.Missed(peer, at(step.seconds))
+		phi.Missed(peer, at(step.seconds))
+		if state := strikes.State(peer, at(step.seconds)); state != step.strikes {
+			t.Errorf("strikes at %gs: %s, want %s", step.seconds, state, step.strikes)
+		}
+		if state := phi.State(peer, at(step.seconds)); state != step.phi {
+			t.Errorf("phi at %gs: %s, want %s", step.seconds, state, step.phi)
+		}
+	}
+	strikes.Heard(peer, at(13))
+	phi.Heard(peer, at(13))
+	if strikes.State(peer, at(13)) != chordnode.PEER_ALIVE || phi.State(peer, at(13)) != chordnode.PEER_ALIVE {
+		t.Errorf("peer not alive again once it replied")
+	}
+	// Peers no one mentions any more are dropped, however they were left, by the
+	// time they have gone unmentioned for twice DETECTOR_MEMORY.
+	for i := 0; i < 100; i++ {
+		other := fmt.Sprintf("tcp://127.0.0.1:%d", utils.MinPort+i)
+		strikes.Missed(other, at(14))
+		phi.Missed(other, at(14))
+		phi.Heard(other, at(15))
+	}
+	later := at(15).Add(2 * chordnode.DETECTOR_MEMORY)
+	strikes.Missed(peer, later)
+	phi.Missed(peer, later)
+	if strikes.Tracked() != 1 || phi.Tracked() != 1 {
+		t.Errorf("detectors hold %d and %d peers, want only the one still failing", strikes.Tracked(), phi.Tracked())
+	}
+
+	transport, nodes := fingeredRing(t, 8, nil)
+	sorted := sortedByID(nodes)
+	before, paused, after := sorted[2], sorted[3], sorted[4]
+	paused.SetFaults(utils.FaultRules{Drop: 1})
+	transport.SendMessage(utils.StabilizeRingCommand(), before.GetOwnAddress())
+	transport.SendMessage(utils.CheckPredecessorCommand(), after.GetOwnAddress())
+	if info := before.Info(); info.Successor == nil || info.Successor.ID != paused.ID || info.Suspects[paused.GetOwnAddress()] != chordnode.PEER_SUSPECT {
+		t.Errorf("after one missed request, successor %v and suspects %v", info.Successor, info.Suspects)
+	}
+	if info := after.Info(); info.Predecessor == nil || info.Predecessor.ID != paused.ID {
+		t.Errorf("after one missed request, predecessor %v", info.Predecessor)
+	}
+	paused.SetFaults(utils.FaultRules{})
+	transport.SendMessage(utils.StabilizeRingCommand(), before.GetOwnAddress())
+	if report := checkRing(t, nodes); !report.OK || len(before.Info().Suspects) > 0 {
+		t.Errorf("ring not back to normal: suspects %v", before.Info().Suspects)
+	}
+}
+
+/*
+Split so that each side's nodes alternate around the ring, each side settles
+into a loop of its own. After healing, stabilization alone leaves the two
+loops apart, and checking the ring through known peers joins them back up.
+*/
+func TestPartitionHeal(t *testing.T) {
+	partition := utils.NewPartition()
+	transport, nodes := fingeredRing(t, 16, func(node *chordnode.ChordNode) {
+		node.Transport = &utils.PartitionTransport{Transport: node.Transport, From: node.GetOwnAddress(), Partition: partition}
+	})
+	sorted := sortedByID(nodes)
+	sides := [2][]*chordnode.ChordNode{}
+	addresses := [2][]string{}
+	for i, node := range sorted {
+		sides[i%2] = append(sides[i%2], node)
+		addresses[i%2] = append(addresses[i%2], node.GetOwnAddress())
+	}
+	// One round of the maintenance tasks on every node, repair included if asked.
+	round := func(repair bool) {
+		for _, node := range nodes {
+			if repair {
+				node.RepairRing()
+			}
+			transport.SendMessage(utils.CheckPredecessorCommand(), node.GetOwnAddress())
+			transport.SendMessage(utils.StabilizeRingCommand(), node.GetOwnAddress())
+			transport.SendMessage(utils.FixRingFingersCommand(), node.GetOwnAddress())
+		}
+	}
+
+	partition.Split(addresses[0], addresses[1])
+	for i := 0; i < 32 && !(converged(sides[0]) && converged(sides[1])); i++ {
+		round(false)
+	}
+	if !converged(sides[0]) || !converged(sides[1]) {
+		t.Fatalf("sides did not settle into loops of their own")
+	}
+
+	partition.Heal()
+	for i := 0; i < 8; i++ {
+		round(false)
+	}
+	if converged(nodes) || !converged(sides[0]) || !converged(sides[1]) {
+		t.Fatalf("loops joined up without repair; the test no longer shows the problem")
+	}
+
+	for i := 0; i < 64 && !converged(nodes); i++ {
+		round(true)
+	}
+	if !converged(nodes) {
+		t.Fatalf("loops did not join up after healing")
+	}
+	for i := 0; i < len(nodes); i++ {
+		round(false)
+	}
+	for _, node := range nodes {
+		for i := 0; i < node.Bits; i++ {
+			transport.SendMessage(utils.FixRingFingersCommand(), node.GetOwnAddress())
+		}
+	}
+	checkRing(t, nodes)
+}
+
+/*
+Repair forgets a peer that stops answering once the detector gives up on it,
+but keeps one that our own fault rules only cut off, to find again on healing.
+*/
+func TestRepairForgetsDeadPeers(t *testing.T) {
+	partition := utils.NewPartition()
+	_, nodes := fingeredRing(t, 8, func(node *chordnode.ChordNode) {
+		node.Transport = &utils.PartitionTransport{Transport: node.Transport, From: node.GetOwnAddress(), Partition: partition}
+	})
+	node := nodes[0]
+	var gone, cut *chordnode.ChordNode
+	for _, other := range nodes[1:] {
+		if !node.Knows(other.GetOwnAddress()) {
+			continue
+		}
+		if gone == nil {
+			gone = other
+		} else if cut == nil {
+			cut = other
+		}
+	}
+	if cut == nil {
+		t.Fatalf("%s knows fewer than two peers", node.ID)
+	}
+
+	// Cut off by a partition, gone never refuses a request: they time out, and
+	// only the detector can give up on it.
+	others := []string{}
+	for _, other := range nodes {
+		if other != gone {
+			others = append(others, other.GetOwnAddress())
+		}
+	}
+	partition.Split([]string{gone.GetOwnAddress()}, others)
+	node.SetFaults(utils.FaultRules{Partition: []utils.ID{cut.ID}})
+	for i := 0; i < 256 && node.Knows(gone.GetOwnAddress()); i++ {
+		node.RepairRing()
+	}
+	if node.Knows(gone.GetOwnAddress()) {
+		t.Errorf("%s still knows %s, %s to the detector", node.ID, gone.ID, node.PeerState(gone.GetOwnAddress()))
+	}
+	if !node.Knows(cut.GetOwnAddress()) {
+		t.Errorf("%s forgot %s, which is only across a partition", node.ID, cut.ID)
+	}
+
+	// A crashed finger refuses lookups too, but must go on looking dead to us.
+	var crashed *chordnode.ChordNode
+	for _, finger := range node.Info().Table {
+		for _, other := range nodes {
+			if finger != nil && other.ID == finger.ID && other != gone && other != cut && node.Knows(other.GetOwnAddress()) {
+				crashed = other
+			}
+		}
+	}
+	if crashed == nil {
+		t.Fatalf("%s knows none of its reachable fingers", node.ID)
+	}
+	crashed.SetFaults(utils.FaultRules{Crash: true})
+	for i := 0; i < 256 && node.Knows(crashed.GetOwnAddress()); i++ {
+		node.RepairRing()
+	}
+	if state := node.PeerState(crashed.GetOwnAddress()); state == chordnode.PEER_ALIVE {
+		t.Errorf("%s forgot its crashed finger %s", node.ID, crashed.ID)
+	}
+}
+
+// What the controller sends on a node's behalf, like the steps of an iterative
+// lookup, is split by a partition just like the node's own requests.
+func TestPartitionedLookup(t *testing.T) {
+	_, nodes := fingeredRing(t, 8, func(node *chordnode.ChordNode) {
+		node.Transport = &utils.PartitionTransport{Transport: node.Transport, From: node.GetOwnAddress(), Partition: partition}
+		// The controller sends through the transports of the nodes it has registered.
+		registry.AddHost(&chordnode.Host{Nodes: []*chordnode.ChordNode{node}})
+		t.Cleanup(func() { registry.Remove(node.ID) })
+	})
+	sorted := sortedByID(nodes)
+	// Past the successor list, so start cannot answer for itself.
+	start, far := sorted[0], sorted[6]
+	if reply, err := lookup(far.ID, start.GetOwnAddress(), utils.LOOKUP_ITERATIVE); err != nil || reply.ID != far.ID {
+		t.Fatalf("lookup before the split: %v %v", reply, err)
+	}
+
+	others := []string{}
+	for _, node := range sorted[1:] {
+		others = append(others, node.GetOwnAddress())
+	}
+	partition.Split([]string{start.GetOwnAddress()}, others)
+	defer partition.Heal()
+	if reply, err := lookup(far.ID, start.GetOwnAddress(), utils.LOOKUP_ITERATIVE); err == nil {
+		t.Errorf("lookup crossed the partition to %s", reply.ID)
+	}
+	// The controller itself still reaches every node.
+	for _, node := range nodes {
+		if _, err := transportFor(node.GetOwnAddress()).SendMessage(utils.PingCommand(), node.GetOwnAddress()); err != nil {
+			t.Errorf("ping %s: %s", node.ID, err.Error())
+		}
+	}
+}
+
+/*
+Both kinds of lookup find the owner by the same route, report it hop by hop,
+and, with every finger right, take no more than about log2(nodes) hops.
+*/
+func TestLookupModes(t *testing.T) {
+	const count = 32
+	transport, nodes := fingeredRing(t, count, nil)
+	for k := 0; k < 64; k++ {
+		key := fmt.Sprint("key-", k)
+		id := utils.ComputeId(key, utils.DEFAULT_BITS)
+		start := nodes[k%count]
+		want := successorIn(nodes, id)
+
+		recursive, err := start.Lookup(id, utils.LOOKUP_RECURSIVE)
+		if err != nil {
+			t.Fatalf("recursive lookup of %s: %s", key, err)
+		}
+		iterative, err := start.Lookup(id, utils.LOOKUP_ITERATIVE)
+		if err != nil {
+			t.Fatalf("iterative lookup of %s: %s", key, err)
+		}
+		for _, reply := range []*utils.FindRingSuccessorReply{recursive, iterative} {
+			if reply.ID != want || reply.Next != nil {
+				t.Errorf("lookup of %s from %s = %s, want %s", key, start.ID, reply.ID, want)
+			}
+			if len(reply.Path) == 0 || reply.Path[0].ID != start.ID || reply.Hops != len(reply.Path)-1 {
+				t.Errorf("lookup of %s from %s went %v in %d hops", key, start.ID, reply.Path, reply.Hops)
+			}
+			if reply.Hops > 6 {
+				t.Errorf("lookup of %s from %s took %d hops", key, start.ID, reply.Hops)
+			}
+		}
+		if fmt.Sprint(recursive.Path) != fmt.Sprint(iterative.Path) {
+			t.Errorf("lookup of %s went %v recursively but %v iteratively", key, recursive.Path, iterative.Path)
+		}
+	}
+
+	// A node asked for one step of an iterative lookup says who to ask next.
+	var step utils.FindRingSuccessorReply
+	for _, node := range nodes {
+		id := utils.FingerStart(nodes[0].ID, utils.DEFAULT_BITS-1, utils.DEFAULT_BITS)
+		reply := sendUntilAnswered(t, transport, utils.LookupCommand(id, node.GetOwnAddress(), utils.LOOKUP_ITERATIVE, nil), node.GetOwnAddress())
+		if err := utils.DecodeReply(reply, &step); err != nil {
+			t.Fatal(err)
+		}
+		if step.Next != nil {
+			break
+		}
+	}
+	if step.Next == nil || len(step.Path) != 1 || step.Hops != 0 {
+		t.Errorf("no node passed on an iterative lookup: %+v", step)
+	}
+}
+
+/*
+Nodes in four racks, close to each other and far from the rest. Routing by
+proximity must find the same owners as routing by progress, over paths that
+take less time.
+*/
+func TestProximityRouting(t *testing.T) {
+	const count = 32
+	const racks = 4
+	// Sleeps can round up to a millisecond, so anything between zero and
+	// that would be blurred.
+	const near = 0
+	const far = time.Millisecond
+	matrix := utils.NewLatencyMatrix()
+	matrix.Default = far
+	rack := func(port int) int { return port % racks }
+	for i := 0; i < count; i++ {
+		for j := i + 1; j < count; j++ {
+			if rack(i) == rack(j) {
+				a := fmt.Sprintf("tcp://%s:%d", utils.Localhost, utils.MinPort+i)
+				b := fmt.Sprintf("tcp://%s:%d", utils.Localhost, utils.MinPort+j)
+				matrix.Set(a, b, near)
+			}
+		}
+	}
+	_, nodes := fingeredRing(t, count, func(node *chordnode.ChordNode) {
+		node.Transport = &utils.LatencyTransport{Transport: node.Transport, From: node.GetOwnAddress(), Matrix: matrix}
+		node.SetRouting(chordnode.ROUTE_PROXIMITY)
+	})
+	for _, node := range nodes {
+		for _, finger := range node.Info().Table {
+			if _, known := node.RTT(finger.Address); finger.ID != node.ID && !known {
+				t.Errorf("node %s never measured its finger %s", node.ID, finger.ID)
+			}
+		}
+	}
+
+	// Time along the path, as the matrix has it.
+	cost := func(path []utils.NodeRef) time.Duration {
+		var total time.Duration
+		for i := 1; i < len(path); i++ {
+			total += 2 * matrix.Latency(path[i-1].Address, path[i].Address)
+		}
+		return total
+	}
+	total := map[string]time.Duration{}
+	for _, routing := range []string{chordnode.ROUTE_PROGRESS, chordnode.ROUTE_PROXIMITY} {
+		for _, node := range nodes {
+			node.SetRouting(routing)
+		}
+		for k := 0; k < 128; k++ {
+			id := utils.ComputeId(fmt.Sprint("key-", k), utils.DEFAULT_BITS)
+			reply, err := nodes[k%count].Lookup(id, utils.LOOKUP_RECURSIVE)
+			if err != nil {
+				t.Fatalf("%s lookup of key-%d: %s", routing, k, err)
+			}
+			if want := successorIn(nodes, id); reply.ID != want {
+				t.Errorf("%s lookup of key-%d = %s, want %s", routing, k, reply.ID, want)
+			}
+			total[routing] += cost(reply.Path)
+		}
+	}
+	if total[chordnode.ROUTE_PROXIMITY] >= total[chordnode.ROUTE_PROGRESS] {
+		t.Errorf("lookups took %s routing by proximity, %s by progress", total[chordnode.ROUTE_PROXIMITY], total[chordnode.ROUTE_PROGRESS])
+	} else {
+		t.Logf("lookups took %s routing by proximity, %s by progress", total[chordnode.ROUTE_PROXIMITY], total[chordnode.ROUTE_PROGRESS])
+	}
+
+	// A request gives up while it is still being held back.
+	slow := utils.NewLatencyMatrix()
+	slow.Default = time.Minute
+	held := &utils.LatencyTransport{Transport: utils.NewMemoryTransport(), From: nodes[0].GetOwnAddress(), Matrix: slow}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := held.SendMessageContext(ctx, utils.PingCommand(), nodes[1].GetOwnAddress()); !errors.Is(err, utils.ErrTimeout) || time.Since(start) > time.Second {
+		t.Errorf("cancelled request through a minute of latency returned %v after %s", err, time.Since(start))
+	}
+}
+
+// A ring of hosts over memory, each running vnodes virtual nodes.
+func hostRing(t *testing.T, hosts int, vnodes int, firstPort int) (*utils.MemoryTransport, []*chordnode.ChordNode) {
+	transport := utils.NewMemoryTransport()
+	nodes := []*chordnode.ChordNode{}
+	for i := 0; i < hosts; i++ {
+		host := chordnode.NewHost(utils.Localhost, firstPort+i, transport, vnodes)
+		for _, node := range host.Nodes {
+			node.Maintenance = chordnode.MaintenanceConfig{}
+		}
+		if err := host.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { host.Stop(context.Background()) })
+		nodes = append(nodes, host.Nodes...)
+	}
+	sourceAddress := nodes[0].GetOwnAddress()
+	sendUntilAnswered(t, transport, utils.CreateRingCommand(), sourceAddress)
+	for _, node := range nodes[1:] {
+		sendUntilAnswered(t, transport, utils.JoinRingCommand(sourceAddress), node.GetOwnAddress())
+	}
+	if !stabilize(transport, nodes, len(nodes)) {
+		t.Fatalf("ring of %d hosts with %d virtual nodes each did not converge", hosts, vnodes)
+	}
+	return transport, nodes
+}
+
+/*
+Virtual nodes share their host's endpoint but find their own places in the
+ring, and with enough of them each host's share of the id space evens out.
+*/
+func TestVirtualNodes(t *testing.T) {
+	const hosts = 8
+	imbalance := map[int]float64{}
+	for _, vnodes := range []int{1, 16} {
+		transport, nodes := hostRing(t, hosts, vnodes, utils.MinPort+vnodes*hosts)
+		for _, node := range nodes {
+			reply := sendUntilAnswered(t, transport, utils.NodeInfoCommand(), node.GetOwnAddress())
+			var info utils.NodeInfoReply
+			if err := utils.DecodeReply(reply, &info); err != nil || info.ID != node.ID {
+				t.Fatalf("node-info from %s = %s", node.GetOwnAddress(), reply)
+			}
+			if vnodes > 1 && info.VirtualNodes != vnodes {
+				t.Errorf("%s says its host runs %d virtual nodes, want %d", node.GetOwnAddress(), info.VirtualNodes, vnodes)
+			}
+		}
+		for k := 0; k < 256; k++ {
+			key := fmt.Sprint("key-", k)
+			sendUntilAnswered(t, transport, utils.PutCommand(key, key), nodes[k%len(nodes)].GetOwnAddress())
+			owner, err := nodes[0].FindKeyOwner(utils.ComputeId(key, utils.DEFAULT_BITS))
+			if want := successorIn(nodes, utils.ComputeId(key, utils.DEFAULT_BITS)); err != nil || owner.ID != want {
+				t.Errorf("owner of %s = %s, want %s", key, owner.ID, want)
+			}
+		}
+
+		infos := map[utils.ID]*utils.NodeInfoReply{}
+		for _, node := range nodes {
+			infos[node.ID] = node.Info()
+		}
+		report := loadReport(infos)
+		total, keys := 0.0, 0
+		for host, load := range report.Hosts {
+			if load.Nodes != vnodes {
+				t.Errorf("%s has %d nodes in the ring, want %d", host, load.Nodes, vnodes)
+			}
+			total += load.Share
+			keys += load.Keys
+		}
+		if len(report.Hosts) != hosts || math.Abs(total-1) > 1e-9 || keys != 256 {
+			t.Errorf("%d hosts share %f of the ids and %d keys, want %d, 1 and 256", len(report.Hosts), total, keys, hosts)
+		}
+		imbalance[vnodes] = report.Share.MaxOverMean
+	}
+	if imbalance[16] >= imbalance[1] {
+		t.Errorf("busiest host has %.2f times its share with 16 virtual nodes each, %.2f with one", imbalance[16], imbalance[1])
+	}
+}
+
+// Sixteen nodes join, take some keys, then two fail and one leaves.
+func churn(seed int64, loss float64) *sim.Simulator {
+	config := sim.DefaultConfig
+	config.Seed = seed
+	config.Loss = loss
+	config.TraceMessages = true
+	s, err := sim.New(config)
+	if err != nil {
+		panic(err)
+	}
+	s.AddNodes(16)
+	script := []sim.Event{{At: 0, Do: sim.CREATE, Node: 0}}
+	for i := 1; i < 16; i++ {
+		script = append(script, sim.Event{At: time.Duration(i) * 200 * time.Millisecond, Do: sim.JOIN, Node: i, Via: 0})
+	}
+	for k := 0; k < 32; k++ {
+		script = append(script, sim.Event{At: 10 * time.Second, Do: sim.PUT, Node: k % 16, Key: fmt.Sprint("key-", k)})
+	}
+	script = append(script,
+		sim.Event{At: 20 * time.Second, Do: sim.FAIL, Node: 3},
+		sim.Event{At: 20 * time.Second, Do: sim.FAIL, Node: 7},
+		sim.Event{At: 25 * time.Second, Do: sim.LEAVE, Node: 5})
+	if err = s.Schedule(script); err != nil {
+		panic(err)
+	}
+	s.Run(time.Minute)
+	return s
+}
+
+// A simulated run recovers from churn, and replays exactly given the same seed.
+func TestSimulator(t *testing.T) {
+	first, again, other := churn(7, 0.02), churn(7, 0.02), churn(8, 0.02)
+	if strings.Join(first.Trace, "\n") != strings.Join(again.Trace, "\n") || first.Sent != again.Sent {
+		t.Errorf("runs with the same seed differ")
+	}
+	if strings.Join(first.Trace, "\n") == strings.Join(other.Trace, "\n") {
+		t.Errorf("runs with different seeds are the same")
+	}
+	if len(first.Live()) != 13 || first.Lost == 0 {
+		t.Errorf("%d live nodes and %d of %d messages lost, want 13 and some", len(first.Live()), first.Lost, first.Sent)
+	}
+
+	// Once messages stop going missing, the ring settles.
+	first.SetLoss(0)
+	first.Run(90 * time.Second)
+	if !first.Converged() {
+		t.Errorf("ring did not converge after churn")
+	}
+
+	// Without loss, every key survives the churn.
+	calm := churn(7, 0)
+	if !calm.Converged() {
+		t.Errorf("ring did not converge after churn without loss")
+	}
+	checkRing(t, calm.Live())
+	for k := 0; k < 32; k++ {
+		key := fmt.Sprint("key-", k)
+		reply, err := calm.Live()[0].Get(key)
+		if err != nil || reply.Status != utils.STATUS_OK {
+			t.Errorf("%s was lost in the churn", key)
+		}
+	}
+
+	config := sim.DefaultConfig
+	config.Bits = 0
+	if _, err := sim.New(config); err == nil {
+		t.Errorf("simulator made with a 0-bit id space")
+	}
+}
+
+// Rings of tiny and SHA-1 sized id spaces form just like 32-bit ones.
+func TestIdSpaces(t *testing.T) {
+	for _, bits := range []int{8, utils.MAX_BITS} {
+		transport := utils.NewMemoryTransport()
+		nodes := []*chordnode.ChordNode{}
+		seen := map[utils.ID]bool{}
+		for port := utils.MinPort; len(nodes) < 16; port++ {
+			node := chordnode.New(utils.Localhost, port, transport)
+			if err := node.SetBits(bits); err != nil {
+				t.Fatal(err)
+			}
+			// 8 bits leave room for collisions.
+			if seen[node.ID] {
+				continue
+			}
+			seen[node.ID] = true
+			if bits == 8 && node.ID.Cmp(utils.NewId(256)) >= 0 {
+				t.Fatalf("%d-bit node has id %s", bits, node.ID)
+			}
+			if len(nodes)%2 == 1 {
+				node.Codec = utils.Binary
+			}
+			node.Maintenance = chordnode.MaintenanceConfig{}
+			nodes = append(nodes, node)
+			go node.Run()
+		}
+		sourceAddress := nodes[0].GetOwnAddress()
+		sendUntilAnswered(t, transport, utils.CreateRingCommand(), sourceAddress)
+		for _, node := range nodes[1:] {
+			sendUntilAnswered(t, transport, utils.JoinRingCommand(sourceAddress), node.GetOwnAddress())
+		}
+		if !stabilize(transport, nodes, 50) {
+			t.Errorf("ring of %d-bit ids did not converge", bits)
+		}
+
+		// A node with a different id space must not join.
+		stranger := chordnode.New(utils.Localhost, utils.MaxPort, transport)
+		go stranger.Run()
+		reply := sendUntilAnswered(t, transport, utils.JoinRingCommand(sourceAddress), stranger.GetOwnAddress())
+		var status utils.StatusReply
+		utils.DecodeReply(reply, &status)
+		if status.Status == utils.STATUS_OK {
+			t.Errorf("32-bit node joined a %d-bit ring", bits)
+		}
+		for _, node := range append(nodes, stranger) {
+			node.Stop(context.Background())
+		}
+	}
+
+	// The visualizer refuses to add nodes with ids it cannot use.
+	defer func(bits int) { Bits = bits }(Bits)
+	Bits = utils.MAX_BITS + 1
+	before := len(registry.Ids())
+	if _, err := addNode(); err == nil || len(registry.Ids()) != before {
+		t.Errorf("added a node with %d-bit ids: %v", Bits, err)
+	}
+}
+
+func TestIdEncoding(t *testing.T) {
+	big, _ := utils.ParseId("1461501637330902918203684832716283019655932542975") // 2^160 - 1
+	small := utils.NewId(3735928559)
+	for _, id := range []utils.ID{big, small, utils.NewId(0)} {
+		m := &utils.RingNotifyRequest{ID: id, ReplyTo: "tcp://127.0.0.1:5001"}
+		for _, codec := range []utils.Codec{utils.JSON, utils.Binary} {
+			decoded, err := utils.Decode(mustEncode(t, codec, m))
+			if err != nil || decoded.(*utils.RingNotifyRequest).ID != id {
+				t.Errorf("%s: %s decoded as %v, %v", codec.Name(), id, decoded, err)
+			}
+		}
+	}
+	// JavaScript reads numbers above 2^53 inexactly, so those are strings.
+	if !strings.Contains(utils.Encode(&utils.RingNotifyRequest{ID: big}), `"1461501637330902918203684832716283019655932542975"`) {
+		t.Errorf("big id not written as a string")
+	}
+	// Older peers read 32-bit ids as plain numbers and uvarints.
+	if !strings.Contains(utils.Encode(&utils.RingNotifyRequest{ID: small}), `"id":3735928559`) {
+		t.Errorf("small id not written as a number")
+	}
+	if !strings.Contains(mustEncode(t, utils.Binary, &utils.RingNotifyRequest{ID: small}), "\xef\xfd\xb6\xf5\x0d") {
+		t.Errorf("small id not written as a uvarint")
+	}
+
+	a, b, c := utils.NewId(250), utils.NewId(3), utils.NewId(10)
+	if !utils.IsBetween(a, b, utils.NewId(1)) || utils.IsBetween(a, b, c) || !utils.IsBetween(b, a, c) {
+		t.Errorf("IsBetween is wrong around zero")
+	}
+}
+
+func TestMaintenanceScheduler(t *testing.T) {
+	const count = 8
+	transport := utils.NewMemoryTransport()
+	nodes := []*chordnode.ChordNode{}
+	for i := 0; i < count; i++ {
+		node := chordnode.New(utils.Localhost, utils.MinPort+i, transport)
+		node.Maintenance = chordnode.MaintenanceConfig{
+			Stabilize:        5 * time.Millisecond,
+			CheckPredecessor: 10 * time.Millisecond,
+			FixFingers:       5 * time.Millisecond,
+			Jitter:           0.5,
+		}
+		nodes = append(nodes, node)
+		go node.Run()
+	}
+	sourceAddress := nodes[0].GetOwnAddress()
+	sendUntilAnswered(t, transport, utils.CreateRingCommand(), sourceAddress)
+	for _, node := range nodes[1:] {
+		sendUntilAnswered(t, transport, utils.JoinRingCommand(sourceAddress), node.GetOwnAddress())
+	}
+
+	// Nobody sends stabilize-ring, so the nodes must converge on their own.
+	deadline := time.Now().Add(10 * time.Second)
+	for !converged(nodes) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !converged(nodes) {
+		t.Errorf("ring of %d nodes did not converge without outside help", count)
+	}
+
+	for _, node := range nodes {
+		if err := node.Stop(context.Background()); err != nil {
+			t.Errorf("stopping %s: %s", node.ID, err.Error())
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	// A request accepted before the transport stops is still answered.
+	transport := utils.NewMemoryTransport()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- transport.Serve(ctx, "slow", func(msg string) (string, error) {
+			time.Sleep(50 * time.Millisecond)
+			return msg, nil
+		})
+	}()
+	replied := make(chan error)
+	go func() {
+		_, err := sendUntilAnsweredErr(transport, "hello", "slow")
+		replied <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-replied; err != nil {
+		t.Errorf("in-flight request was not answered: %s", err.Error())
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %s", err.Error())
+	}
+
+	// A stopped node releases its address and can be started again.
+	node := chordnode.New(utils.Localhost, utils.MinPort, transport)
+	node.Start(context.Background())
+	sendUntilAnswered(t, transport, utils.CreateRingCommand(), node.GetOwnAddress())
+	if err := node.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop returned %s", err.Error())
+	}
+	_, err := transport.SendMessage(utils.PingCommand(), node.GetOwnAddress())
+	if !errors.Is(err, utils.ErrDropped) {
+		t.Errorf("stopped node answered ping, err = %v", err)
+	}
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatalf("restart returned %s", err.Error())
+	}
+	sendUntilAnswered(t, transport, utils.PingCommand(), node.GetOwnAddress())
+	node.Stop(context.Background())
+}
+
+// Handlers add, remove and list nodes concurrently. Run with -race.
+func TestRegistryConcurrentAccess(t *testing.T) {
+	registry := NewRegistry()
+	transport := utils.NewMemoryTransport()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				host := chordnode.NewHost(utils.Localhost, utils.MinPort+i*50+j, transport, 1)
+				node := host.Nodes[0]
+				registry.AddHost(host)
+				registry.Ids()
+				registry.Directory()
+				if address, present := registry.Address(node.ID); !present || address != node.GetOwnAddress() {
+					t.Errorf("address of %s = %s, want %s", node.ID, address, node.GetOwnAddress())
+				}
+				if j%2 == 0 {
+					registry.Remove(node.ID)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(registry.Ids()) != 8*25 || len(registry.Nodes()) != 8*25 || len(registry.Directory()) != 8*25 {
+		t.Errorf("registry holds %d ids, %d nodes, %d addresses; want %d of each",
+			len(registry.Ids()), len(registry.Nodes()), len(registry.Directory()), 8*25)
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	node := chordnode.New(utils.Localhost, utils.MinPort, utils.NewMemoryTransport())
+	cases := map[string]string{
+		`not json`:                  utils.ERR_MALFORMED,
+		`{"id": 5}`:                 utils.ERR_MALFORMED,
+		`{"do": 7}`:                 utils.ERR_MALFORMED,
+		`{"do": "no-such-command"}`: utils.ERR_UNKNOWN_COMMAND,
+		`{"do": "join-ring"}`:       utils.ERR_INVALID,
+		`{"do": "ring-notify", "id": "five", "reply-to": "x"}`: utils.ERR_MALFORMED,
+	}
+	for msg, code := range cases {
+		reply, err := node.ProcessIncomingCommand(msg)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", msg, err.Error())
+			continue
+		}
+		var status utils.StatusReply
+		err = utils.DecodeReply(reply, &status)
+		if msgErr, ok := err.(*utils.MessageError); !ok || msgErr.Code != code {
+			t.Errorf("%s: reply = %s, want code %s", msg, reply, code)
+		}
+	}
+
+	// Envelopes without content, which the zmq worker answers as malformed.
+	for _, msg := range [][]string{nil, {"0001-0002"}} {
+		if _, _, err := utils.Pop(msg); err == nil {
+			t.Errorf("popped %q", msg)
+		}
+	}
+	if id, content, err := utils.Pop([]string{"0001-0002", ""}); err != nil || len(id) != 2 || len(content) != 0 {
+		t.Errorf("popped an empty delimited message as %q, %q, %v", id, content, err)
+	}
+}
+
+func TestProtocolVersions(t *testing.T) {
+	node := chordnode.New(utils.Localhost, utils.MinPort, utils.NewMemoryTransport())
+	node.ProcessIncomingCommand(utils.CreateRingCommand())
+	cases := map[string]string{
+		// Unversioned messages come from version 1 peers.
+		`{"do": "ping"}`:                          "",
+		`{"do": "ping", "version": 99}`:           "",
+		`{"do": "ping", "version": 0}`:            utils.ERR_UNSUPPORTED_VERSION,
+		`{"do": "bulk-put", "items": {}}`:         utils.ERR_INCOMPATIBLE_VERSION,
+		`{"do": "node-info"}`:                     utils.ERR_INCOMPATIBLE_VERSION,
+		`{"do": "set-faults", "faults": {}}`:      utils.ERR_INCOMPATIBLE_VERSION,
+		`{"do": "hello", "versions": [1, 2, 3]}`:  "",
+		`{"do": "hello", "versions": [7]}`:        utils.ERR_UNSUPPORTED_VERSION,
+	}
+	for msg, code := range cases {
+		reply, err := node.ProcessIncomingCommand(msg)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", msg, err.Error())
+			continue
+		}
+		var status utils.StatusReply
+		err = utils.DecodeReply(reply, &status)
+		msgErr, _ := err.(*utils.MessageError)
+		if (code == "" && err != nil) || (code != "" && (msgErr == nil || msgErr.Code != code)) {
+			t.Errorf("%s: reply = %s, want code %q", msg, reply, code)
+		}
+	}
+
+	reply, _ := node.ProcessIncomingCommand(`{"do": "hello", "version": 2, "versions": [1, 2], "features": ["batching", "teleport"]}`)
+	var hello utils.HelloReply
+	utils.DecodeReply(reply, &hello)
+	if hello.Version != utils.PROTOCOL_VERSION || len(hello.Features) != 1 || hello.Features[0] != utils.FEATURE_BATCHING {
+		t.Errorf("hello reply = %s", reply)
+	}
+}
+
+/*
+Plays a peer at Address that speaks protocol version 1, recording the commands
+it is sent. Every other address is unreachable.
+*/
+type versionOneTransport struct {
+	utils.Transport
+	Address	string
+	mux	sync.Mutex // Guards sent.
+	sent	map[string]int
+}
+
+func (t *versionOneTransport) SendMessage(msg string, address string) (string, error) {
+	return t.SendMessageContext(context.Background(), msg, address)
+}
+
+func (t *versionOneTransport) SendMessageContext(ctx context.Context, msg string, address string) (string, error) {
+	m, _ := utils.CodecOf(msg).Decode(msg)
+	t.mux.Lock()
+	t.sent[m.Command()]++
+	t.mux.Unlock()
+	if address != t.Address {
+		return "", &utils.SendError{Address: address, Attempts: 1, Err: utils.ErrTimeout}
+	}
+	switch m.(type) {
+	case *utils.HelloRequest:
+		return utils.EncodeReply(&utils.HelloReply{Version: 1}), nil
+	case *utils.FindRingPredecessorRequest:
+		return utils.EncodeReply(&utils.PredecessorReply{}), nil
+	}
+	return utils.EncodeReply(utils.OkReply("")), nil
+}
+
+func (t *versionOneTransport) count(command string) int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.sent[command]
+}
+
+// Peers are sent only what their protocol version knows, and a failed handshake
+// is neither retried at once nor counted against the peer.
+func TestHandshakeDowngrade(t *testing.T) {
+	transport := &versionOneTransport{Transport: utils.NewMemoryTransport(), Address: "tcp://127.0.0.1:1", sent: map[string]int{}}
+	node := chordnode.New(utils.Localhost, utils.MinPort, transport)
+	strikes := chordnode.NewStrikesDetector(1, chordnode.DEFAULT_DEAD_STRIKES)
+	node.Detector = strikes
+	node.ProcessIncomingCommand(utils.CreateRingCommand())
+	old := utils.NodeRef{ID: node.ID.Add(big.NewInt(100), node.Bits), Address: transport.Address}
+	node.Successor = &old
+	node.SuccessorList = []utils.NodeRef{old}
+
+	if info, err := node.Handshake(old.Address); err != nil || info.Version != 1 {
+		t.Fatalf("handshake with a version 1 peer: %+v, %v", info, err)
+	}
+	node.StabilizeRing()
+	if transport.count("ring-notify") != 1 || transport.count("get-successor-list") != 0 {
+		t.Errorf("stabilizing with a version 1 successor sent %v", transport.sent)
+	}
+
+	dead := "tcp://127.0.0.1:2"
+	for i := 0; i < 2; i++ {
+		if _, err := node.Handshake(dead); err == nil {
+			t.Errorf("handshake with an unreachable peer succeeded")
+		}
+	}
+	if transport.count("hello") != 2 || strikes.Tracked() != 0 {
+		t.Errorf("sent %d hellos and holds %d peers after two failed handshakes, want 2 and 0", transport.count("hello"), strikes.Tracked())
+	}
+}
+
+func TestBinaryCodec(t *testing.T) {
+	pred := utils.NewId(7)
+	requests := []utils.Message{
+		&utils.FindRingSuccessorRequest{ID: utils.NewId(4000000000), ReplyTo: "tcp://127.0.0.1:5001"},
+		&utils.NotifyOrderlyLeaveRequest{Leaver: utils.NewId(3), Predecessor: &pred},
+		&utils.BulkPutRequest{From: pred, Items: map[string]string{"a": "1", "b": ""}},
+		&utils.HelloRequest{Versions: []int{1, 2}, Features: utils.Features},
+		&utils.SetFaultsRequest{Faults: utils.FaultRules{Drop: 0.5}},
+	}
+	for _, request := range requests {
+		decoded, err := utils.Decode(mustEncode(t, utils.Binary, request))
+		if err != nil {
+			t.Errorf("%s: %s", request.Command(), err.Error())
+			continue
+		}
+		if utils.Encode(decoded) != utils.Encode(request) {
+			t.Errorf("%s: decoded %s, want %s", request.Command(), utils.Encode(decoded), utils.Encode(request))
+		}
+	}
+
+	var reply utils.PredecessorReply
+	err := utils.DecodeReply(mustEncodeReply(t, utils.Binary, &utils.PredecessorReply{ID: &pred}), &reply)
+	if err != nil || reply.ID == nil || *reply.ID != pred {
+		t.Errorf("predecessor reply = %v, %v", reply.ID, err)
+	}
+	err = utils.DecodeReply(mustEncodeReply(t, utils.Binary, utils.ErrorReply(utils.ERR_INVALID, "bad")), &reply)
+	if msgErr, ok := err.(*utils.MessageError); !ok || msgErr.Code != utils.ERR_INVALID {
+		t.Errorf("error reply decoded as %v", err)
+	}
+	faults := utils.FaultRules{Partition: []utils.ID{pred}, Drop: 0.25, Corrupt: 0.125}
+	var info utils.NodeInfoReply
+	err = utils.DecodeReply(mustEncodeReply(t, utils.Binary, &utils.NodeInfoReply{ID: pred, Faults: &faults}), &info)
+	if err != nil || info.Faults == nil || info.Faults.Drop != 0.25 || info.Faults.Corrupt != 0.125 || len(info.Faults.Partition) != 1 {
+		t.Errorf("faulted node info = %v, %v", info.Faults, err)
+	}
+	if _, err := utils.Binary.EncodeReply(&struct{ C chan int }{}); err == nil {
+		t.Errorf("encoded a channel")
+	}
+
+	// A node answers in the format it was asked in.
+	node := chordnode.New(utils.Localhost, utils.MinPort, utils.NewMemoryTransport())
+	node.ProcessIncomingCommand(utils.CreateRingCommand())
+	answer, _ := node.ProcessIncomingCommand(mustEncode(t, utils.Binary, &utils.PingRequest{}))
+	if utils.CodecOf(answer) != utils.Binary {
+		t.Errorf("binary ping answered with %q", answer)
+	}
+
+	encoded := mustEncode(t, utils.Binary, requests[0])
+	for _, msg := range []string{encoded[:len(encoded)-1], encoded + "x", "\xc4"} {
+		if _, err := utils.Decode(msg); err == nil {
+			t.Errorf("%q: decoded a damaged frame", msg)
+		}
+	}
+}
+
+func mustEncode(tb testing.TB, codec utils.Codec, m utils.Message) string {
+	msg, err := codec.Encode(m)
+	if err != nil {
+		tb.Fatalf("%s: %s", m.Command(), err.Error())
+	}
+	return msg
+}
+
+func mustEncodeReply(tb testing.TB, codec utils.Codec, reply interface{}) string {
+	msg, err := codec.EncodeReply(reply)
+	if err != nil {
+		tb.Fatalf("%T: %s", reply, err.Error())
+	}
+	return msg
+}
+
+// The messages exchanged on every stabilize, notify and fix-finger round.
+var maintenanceMessages = []utils.Message{
+	&utils.FindRingSuccessorRequest{ID: utils.NewId(3735928559), ReplyTo: "tcp://127.0.0.1:5001"},
+	&utils.RingNotifyRequest{ID: utils.NewId(3735928559), ReplyTo: "tcp://127.0.0.1:5001"},
+	&utils.FindRingPredecessorRequest{},
+}
+
+func benchmarkCodec(b *testing.B, codec utils.Codec) {
+	pred := utils.NewId(3735928559)
+	for i := 0; i < b.N; i++ {
+		for _, m := range maintenanceMessages {
+			if _, err := codec.Decode(mustEncode(b, codec, m)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		var reply utils.PredecessorReply
+		if err := codec.DecodeReply(mustEncodeReply(b, codec, &utils.PredecessorReply{ID: &pred}), &reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONCodec(b *testing.B) {
+	benchmarkCodec(b, utils.JSON)
+}
+
+func BenchmarkBinaryCodec(b *testing.B) {
+	benchmarkCodec(b, utils.Binary)
+}
+
+// Hands msg straight to node, as its worker would, so no network is needed.
+func handleDirect(t *testing.T, node *chordnode.ChordNode, msg string) string {
+	reply, err := node.ProcessIncomingCommand(msg)
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err.Error())
+	}
+	return reply
+}
+
+func jsonReply(t *testing.T, node *chordnode.ChordNode, msg string) *gabs.Container {
+	reply := handleDirect(t, node, msg)
+	jsonParsed, err := gabs.ParseJSON([]byte(reply))
+	if err != nil {
+		t.Fatalf("%s: reply %q: %s", msg, reply, err.Error())
+	}
+	return jsonParsed
+}
+
+// The keys node holds as their owner.
+func itemsOn(t *testing.T, node *chordnode.ChordNode) map[string]string {
+	children, _ := jsonReply(t, node, utils.ListItemsCommand()).Search("items").ChildrenMap()
+	items := map[string]string{}
+	for k, v := range children {
+		items[k], _ = v.Data().(string)
+	}
+	return items
+}
+
+// The id offset places after node's own, around the ring.
+func idAfter(node *chordnode.ChordNode, offset int64) utils.ID {
+	return node.ID.Add(big.NewInt(offset), node.Bits)
+}
+
+// A node that has started a ring of its own and knows no one else.
+func ringOfOne(t *testing.T) *chordnode.ChordNode {
+	node := chordnode.New(utils.Localhost, utils.MinPort, utils.NewMemoryTransport())
+	handleDirect(t, node, utils.CreateRingCommand())
+	return node
+}
+
+// A ring of one whose predecessor sits just past it, so the node owns every key
+// and answers for them without asking anyone.
+func loneNode(t *testing.T) *chordnode.ChordNode {
+	node := ringOfOne(t)
+	node.Predecessor = &utils.NodeRef{ID: idAfter(node, 1), Address: "tcp://127.0.0.1:1"}
+	return node
+}
+
+// Put, get and remove on the owner, with missing keys reported as not found.
+func TestLocalKeyValue(t *testing.T) {
+	node := loneNode(t)
+	steps := []struct {
+		msg, status, value	string
+	}{
+		{utils.GetCommand("key"), utils.STATUS_NOT_FOUND, ""},
+		{utils.RemoveCommand("key"), utils.STATUS_NOT_FOUND, ""},
+		{utils.PutCommand("key", "value"), utils.STATUS_OK, "value"},
+		{utils.GetCommand("key"), utils.STATUS_OK, "value"},
+		{utils.RemoveCommand("key"), utils.STATUS_OK, "value"},
+		{utils.GetCommand("key"), utils.STATUS_NOT_FOUND, ""},
+	}
+	for _, step := range steps {
+		reply := jsonReply(t, node, step.msg)
+		status, _ := reply.Path("status").Data().(string)
+		value, _ := reply.Path("value").Data().(string)
+		if status != step.status || value != step.value {
+			t.Errorf("%s: %s %q, want %s %q", step.msg, status, value, step.status, step.value)
+		}
+	}
+
+	handleDirect(t, node, utils.PutCommand("a", "1"))
+	handleDirect(t, node, utils.PutCommand("b", "2"))
+	if items := itemsOn(t, node); len(items) != 2 || items["a"] != "1" || items["b"] != "2" {
+		t.Errorf("list-items: %v", items)
+	}
+}
+
+// Replicas are kept apart from the node's own keys and served by get-replica,
+// until a new predecessor shows that their owner has failed.
+func TestReplicaStorage(t *testing.T) {
+	node := ringOfOne(t)
+	failed, alive := idAfter(node, -10), idAfter(node, -30)
+	handleDirect(t, node, utils.ReplicateCommand(failed, map[string]string{"a": "1"}))
+	handleDirect(t, node, utils.ReplicateCommand(alive, map[string]string{"b": "2"}))
+	if items := itemsOn(t, node); len(items) != 0 {
+		t.Errorf("replicas stored as our own keys: %v", items)
+	}
+	reply := jsonReply(t, node, utils.GetReplicaCommand("b"))
+	if value, _ := reply.Path("value").Data().(string); value != "2" {
+		t.Errorf("get-replica: %s", reply.String())
+	}
+	// A delta changes only the keys it names.
+	handleDirect(t, node, utils.ReplicateDeltaCommand(alive, map[string]string{"c": "3"}, []string{"b"}))
+	if reply := jsonReply(t, node, utils.GetReplicaCommand("b")); reply.Path("status").Data() != utils.STATUS_NOT_FOUND {
+		t.Errorf("get-replica of a removed key: %s", reply.String())
+	}
+	if reply := jsonReply(t, node, utils.GetReplicaCommand("a")); reply.Path("value").Data() != "1" {
+		t.Errorf("get-replica of another owner's key after a delta: %s", reply.String())
+	}
+
+	// Only the owner between the new predecessor and us is gone.
+	handleDirect(t, node, utils.RingNotifyCommand(idAfter(node, -20), "tcp://127.0.0.1:1"))
+	if items := itemsOn(t, node); len(items) != 1 || items["a"] != "1" {
+		t.Errorf("after a predecessor past %s joined, own keys %v", failed, items)
+	}
+}
+
+// Lookups are answered from the successor list where it covers the id, and a
+// successor's orderly leave takes it off the list.
+func TestSuccessorListRouting(t *testing.T) {
+	node := ringOfOne(t)
+	peer := func(offset int64) utils.NodeRef {
+		return utils.NodeRef{ID: idAfter(node, offset), Address: fmt.Sprintf("tcp://%s:%d", utils.Localhost, utils.MinPort+int(offset))}
+	}
+	a, b, c := peer(100), peer(200), peer(300)
+	node.Successor = &a
+	node.SuccessorList = []utils.NodeRef{a, b, c}
+	node.SecondNode = true
+	if found, more, err := node.FindRingSuccessor(idAfter(node, 150), node.GetOwnAddress()); err != nil || more || found != b {
+		t.Errorf("successor of %s: %v, more %t, %v; want %v", idAfter(node, 150), found, more, err, b)
+	}
+	if found := node.ClosestPrecedingNode(idAfter(node, 400)); found != c {
+		t.Errorf("closest preceding node of %s: %v, want %v", idAfter(node, 400), found, c)
+	}
+
+	node.ProcessOrderlyLeave(a.ID, nil, &b)
+	if *node.Successor != b || fmt.Sprint(node.SuccessorList) != fmt.Sprint([]utils.NodeRef{b, c}) {
+		t.Errorf("after %s left, successor %v and list %v", a.ID, *node.Successor, node.SuccessorList)
+	}
+}
+
+// Keys handed over by a successor become our own.
+func TestKeyTransferAccept(t *testing.T) {
+	node := loneNode(t)
+	node.Successor = &utils.NodeRef{ID: idAfter(node, 1), Address: "tcp://127.0.0.1:1"}
+	handleDirect(t, node, utils.PutCommand("a", "old"))
+	reply := jsonReply(t, node, utils.TransferKeysCommand(idAfter(node, 2), map[string]string{"a": "stranger"}))
+	if status, _ := reply.Path("status").Data().(string); status != utils.STATUS_ERROR {
+		t.Errorf("transfer-keys from a node other than our successor: %s", reply.String())
+	}
+	reply = jsonReply(t, node, utils.TransferKeysCommand(idAfter(node, 1), map[string]string{"a": "new", "b": "2"}))
+	if message, _ := reply.Path("message").Data().(string); !strings.HasPrefix(message, "Accepted 2 keys") {
+		t.Errorf("transfer-keys: %s", reply.String())
+	}
+	if items := itemsOn(t, node); len(items) != 2 || items["a"] != "new" || items["b"] != "2" {
+		t.Errorf("after the transfer, own keys %v", items)
+	}
+}
+
+// A bulk-put is stored and counted, and a node with no one to take its keys
+// refuses an orderly leave rather than drop them.
+func TestBulkPutHandOff(t *testing.T) {
+	node := loneNode(t)
+	reply := jsonReply(t, node, utils.BulkPutCommand(idAfter(node, 1), map[string]string{"a": "1", "b": "2", "c": "3"}))
+	if status, _ := reply.Path("status").Data().(string); status != utils.STATUS_OK || reply.Path("count").Data() != 3.0 {
+		t.Errorf("bulk-put: %s", reply.String())
+	}
+
+	reply = jsonReply(t, node, utils.LeaveRingCommand("orderly"))
+	if status, _ := reply.Path("status").Data().(string); status == utils.STATUS_OK {
+		t.Errorf("left with no successor to take the keys: %s", reply.String())
+	}
+	if items := itemsOn(t, node); len(items) != 3 {
+		t.Errorf("after the refused leave, own keys %v", items)
+	}
+}
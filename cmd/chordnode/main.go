@@ -0,0 +1,303 @@
+/*
+Runs a Chord node as its own process, or with -vnodes several virtual nodes
+that share its address, each with its own place in the ring.
+
+	chordnode -bind tcp://10.0.0.5:5555 -bootstrap tcp://10.0.0.1:5555
+
+Without -bootstrap the node waits for a create-ring or join-ring command, unless
+-create is given, in which case it starts a new ring. Settings may also come
+from a JSON file given by -config, whose keys are the flag names; flags given on
+the command line take precedence over the file.
+
+On SIGINT or SIGTERM each node hands its keys to its successor, leaves the ring
+and exits.
+*/
+package main
+
+import (
+	cn "chord/chordNode"
+	"chord/utils"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long to keep trying the bootstrap node before giving up.
+const JOIN_TIMEOUT = 30 * time.Second
+const JOIN_RETRY_DELAY = 500 * time.Millisecond
+// How long to wait for in-flight requests on shutdown.
+const STOP_TIMEOUT = 10 * time.Second
+
+type Config struct {
+	Bind			string	`json:"bind"`
+	Bootstrap		string	`json:"bootstrap"`
+	Create			bool	`json:"create"`
+	Codec			string	`json:"codec"`
+	Bits			int	`json:"bits"`
+	ReplicationFactor	int	`json:"replication-factor"`
+	VirtualNodes		int	`json:"vnodes"`
+	Lookup			string	`json:"lookup"`
+	Routing			string	`json:"routing"`
+	Detector		string	`json:"detector"`
+	SuccessorListSize	int	`json:"successor-list-size"`
+	Stabilize		string	`json:"stabilize"`
+	CheckPredecessor	string	`json:"check-predecessor"`
+	FixFingers		string	`json:"fix-fingers"`
+	Replicate		string	`json:"replicate"`
+	Repair			string	`json:"repair"`
+	Jitter			float64	`json:"jitter"`
+	Debug			bool	`json:"debug"`
+}
+
+func main() {
+	config, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	utils.DEBUG = config.Debug
+
+	host, err := newHost(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = host.Start(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	for _, node := range host.Nodes {
+		fmt.Printf("Node %s serving on %s\n", node.ID, node.GetOwnAddress())
+	}
+
+	// The other virtual nodes join through the first when we start the ring.
+	bootstrap := config.Bootstrap
+	for _, node := range host.Nodes {
+		if bootstrap != "" {
+			err = join(ctx, node, bootstrap)
+		} else if config.Create {
+			err = statusError(node.CreateRing())
+			bootstrap = node.GetOwnAddress()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		shutdown(host)
+		os.Exit(1)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-waitFor(host):
+		fmt.Fprintln(os.Stderr, "Transport stopped")
+		os.Exit(1)
+	}
+	shutdown(host)
+}
+
+// Defaults, then the config file, then any flags given on the command line.
+func loadConfig(args []string) (*Config, error) {
+	config := Config{
+		Bind:              fmt.Sprintf("tcp://%s:%d", utils.Localhost, utils.MinPort),
+		Codec:             utils.Binary.Name(),
+		Bits:              utils.DEFAULT_BITS,
+		ReplicationFactor: cn.DEFAULT_REPLICATION_FACTOR,
+		VirtualNodes:      1,
+		Lookup:            utils.LOOKUP_RECURSIVE,
+		Routing:           cn.ROUTE_PROGRESS,
+		Detector:          cn.DETECT_STRIKES,
+		SuccessorListSize: cn.DEFAULT_SUCCESSOR_LIST_SIZE,
+		Stabilize:         cn.DefaultMaintenance.Stabilize.String(),
+		CheckPredecessor:  cn.DefaultMaintenance.CheckPredecessor.String(),
+		FixFingers:        cn.DefaultMaintenance.FixFingers.String(),
+		Replicate:         cn.DefaultMaintenance.Replicate.String(),
+		Repair:            cn.DefaultMaintenance.Repair.String(),
+		Jitter:            cn.DefaultMaintenance.Jitter,
+	}
+	flags := flag.NewFlagSet("chordnode", flag.ContinueOnError)
+	configFile := flags.String("config", "", "JSON file with settings, keyed by flag name")
+	flags.StringVar(&config.Bind, "bind", config.Bind, "address to serve on, e.g. tcp://127.0.0.1:5555")
+	flags.StringVar(&config.Bootstrap, "bootstrap", config.Bootstrap, "address of a node in the ring to join")
+	flags.BoolVar(&config.Create, "create", config.Create, "start a new ring if no -bootstrap is given")
+	flags.StringVar(&config.Codec, "codec", config.Codec, "wire format for requests we send: binary or json")
+	flags.IntVar(&config.Bits, "bits", config.Bits, "width of the id space; every node in the ring must use the same")
+	flags.IntVar(&config.ReplicationFactor, "replication-factor", config.ReplicationFactor, "successors that hold a copy of our keys")
+	flags.IntVar(&config.VirtualNodes, "vnodes", config.VirtualNodes, "virtual nodes to run, each with its own place in the ring")
+	flags.StringVar(&config.Lookup, "lookup", config.Lookup, "how lookups we start travel: recursive or iterative")
+	flags.StringVar(&config.Routing, "routing", config.Routing, "how to pick the next hop: progress, or proximity to favor nearby peers")
+	flags.StringVar(&config.Detector, "detector", config.Detector, "how to decide a peer has failed: strikes, after missed requests in a row, or phi, after an unlikely silence")
+	flags.IntVar(&config.SuccessorListSize, "successor-list-size", config.SuccessorListSize, "successors tracked for failover")
+	flags.StringVar(&config.Stabilize, "stabilize", config.Stabilize, "stabilize interval, 0 to disable")
+	flags.StringVar(&config.CheckPredecessor, "check-predecessor", config.CheckPredecessor, "predecessor check interval, 0 to disable")
+	flags.StringVar(&config.FixFingers, "fix-fingers", config.FixFingers, "finger repair interval, 0 to disable")
+	flags.StringVar(&config.Replicate, "replicate", config.Replicate, "replication interval, 0 to disable")
+	flags.StringVar(&config.Repair, "repair", config.Repair, "interval between checks of the ring through a random known peer, 0 to disable")
+	flags.Float64Var(&config.Jitter, "jitter", config.Jitter, "random extra wait, as a fraction of each interval")
+	flags.BoolVar(&config.Debug, "debug", config.Debug, "log every message")
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		// The file overwrites every setting, so remember what was given on the command line.
+		given := map[string]string{}
+		flags.Visit(func(f *flag.Flag) {
+			given[f.Name] = f.Value.String()
+		})
+		contents, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(contents, &config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", *configFile, err.Error())
+		}
+		for name, value := range given {
+			flags.Set(name, value)
+		}
+	}
+	return &config, nil
+}
+
+func newHost(config *Config) (*cn.Host, error) {
+	host, port, err := splitAddress(config.Bind)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := utils.CodecByName(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if config.VirtualNodes < 1 {
+		return nil, fmt.Errorf("vnodes: need at least one, not %d", config.VirtualNodes)
+	}
+	if config.ReplicationFactor < 0 {
+		return nil, fmt.Errorf("replication-factor: cannot be negative, not %d", config.ReplicationFactor)
+	}
+	if config.SuccessorListSize < 1 {
+		return nil, fmt.Errorf("successor-list-size: need at least one, not %d", config.SuccessorListSize)
+	}
+	if config.Lookup != utils.LOOKUP_RECURSIVE && config.Lookup != utils.LOOKUP_ITERATIVE {
+		return nil, fmt.Errorf("lookup: unknown mode %s", config.Lookup)
+	}
+	maintenance := cn.MaintenanceConfig{Jitter: config.Jitter}
+	intervals := []struct {
+		name	string
+		value	string
+		into	*time.Duration
+	}{
+		{"stabilize", config.Stabilize, &maintenance.Stabilize},
+		{"check-predecessor", config.CheckPredecessor, &maintenance.CheckPredecessor},
+		{"fix-fingers", config.FixFingers, &maintenance.FixFingers},
+		{"replicate", config.Replicate, &maintenance.Replicate},
+		{"repair", config.Repair, &maintenance.Repair},
+	}
+	for _, interval := range intervals {
+		*interval.into, err = time.ParseDuration(interval.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", interval.name, err.Error())
+		}
+	}
+
+	h := cn.NewHost(host, port, utils.ZmqTransport{}, config.VirtualNodes)
+	for _, node := range h.Nodes {
+		err = node.SetBits(config.Bits)
+		if err != nil {
+			return nil, err
+		}
+		node.Codec = codec
+		node.Maintenance = maintenance
+		node.ReplicationFactor = config.ReplicationFactor
+		node.LookupMode = config.Lookup
+		err = node.SetRouting(config.Routing)
+		if err != nil {
+			return nil, err
+		}
+		node.Detector, err = cn.NewDetector(config.Detector)
+		if err != nil {
+			return nil, err
+		}
+		node.SuccessorListSize = config.SuccessorListSize
+	}
+	return h, nil
+}
+
+// Split tcp://host:port into host and port.
+func splitAddress(address string) (string, int, error) {
+	host, portText, err := net.SplitHostPort(strings.TrimPrefix(address, "tcp://"))
+	if err != nil {
+		return "", 0, fmt.Errorf("bind: %s", err.Error())
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return "", 0, fmt.Errorf("bind: bad port %s", portText)
+	}
+	return host, port, nil
+}
+
+// Join through bootstrap, retrying while it starts up.
+func join(ctx context.Context, node *cn.ChordNode, bootstrap string) error {
+	deadline := time.Now().Add(JOIN_TIMEOUT)
+	for {
+		err := statusError(node.JoinRing(bootstrap))
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		utils.Debug("[chordnode] Join through %s failed, retrying: %s\n", bootstrap, err.Error())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(JOIN_RETRY_DELAY):
+		}
+	}
+}
+
+func statusError(reply *utils.StatusReply) error {
+	if reply.Status != utils.STATUS_OK {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
+func waitFor(host *cn.Host) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		host.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// Leave the ring in an orderly way and stop serving.
+func shutdown(host *cn.Host) {
+	for _, node := range host.Nodes {
+		if node.IsInRing() {
+			err := statusError(node.LeaveRing("orderly"))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Leaving without handing off keys: "+err.Error())
+				node.LeaveRing("rude")
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), STOP_TIMEOUT)
+	defer cancel()
+	host.Stop(ctx)
+}
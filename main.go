@@ -4,34 +4,212 @@ import (
 	cn "chord/chordNode"
 	"chord/utils"
 
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/exec"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
 const DEBUG = true
-const STABILIZE_TIME = 750
-const CHK_PREDECESSOR_TIME = 1500
-const FIX_FINGER_TIME = 1000
+// Format nodes use for the requests they send. Switch to utils.JSON to read
+// the traffic when debugging.
+var WireCodec = utils.Binary
+// How long DELETE /nodes/{id} waits for a node to finish its requests.
+const STOP_TIMEOUT = 10 * time.Second
 
-// Map of Node ids to addresses
-var NodeDirectory map[uint32]string
+/*
+A chordnode process managed by the controller. cmd is nil for daemons we were
+told to attach to rather than started ourselves.
+*/
+type daemon struct {
+	address	string
+	vnodes	int // Virtual nodes it runs.
+	cmd	*exec.Cmd
+	exited	chan struct{}
+}
+
+/*
+Every node the controller manages, whether it runs in this process or as a
+daemon, and its address. Virtual nodes are listed one by one, along with the
+host or daemon serving them. The HTTP handlers run concurrently, so the maps are
+only used through these methods, which hand out copies.
+*/
+type Registry struct {
+	mux		sync.RWMutex
+	nodes		map[utils.ID]*cn.ChordNode // Nodes running in this process.
+	hosts		map[utils.ID]*cn.Host // The host of each node running in this process.
+	daemons		map[utils.ID]*daemon // Nodes running in their own processes.
+	directory	map[utils.ID]string // Address of every node, by id.
+	ids		[]utils.ID // In the order the nodes were added.
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		nodes:     map[utils.ID]*cn.ChordNode{},
+		hosts:     map[utils.ID]*cn.Host{},
+		daemons:   map[utils.ID]*daemon{},
+		directory: map[utils.ID]string{},
+	}
+}
+
+var registry = NewRegistry()
+
+// How POST /partition splits the hosts we run in this process.
+var partition = utils.NewPartition()
+
+func (r *Registry) AddHost(host *cn.Host) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, node := range host.Nodes {
+		r.nodes[node.ID] = node
+		r.hosts[node.ID] = host
+		r.add(node.ID, node.GetOwnAddress())
+	}
+}
+
+// Returns the id of the daemon's first virtual node.
+func (r *Registry) AddDaemon(d *daemon) utils.ID {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for i := d.vnodes - 1; i >= 0; i-- {
+		address := utils.VirtualAddress(d.address, i)
+		id := utils.ComputeId(address, Bits)
+		r.daemons[id] = d
+		r.add(id, address)
+	}
+	return utils.ComputeId(d.address, Bits)
+}
+
+// Called with mux held.
+func (r *Registry) add(id utils.ID, address string) {
+	if _, present := r.directory[id]; !present {
+		r.ids = append(r.ids, id)
+	}
+	r.directory[id] = address
+}
+
+func (r *Registry) Remove(id utils.ID) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	delete(r.nodes, id)
+	delete(r.hosts, id)
+	delete(r.daemons, id)
+	delete(r.directory, id)
+	for i, nid := range r.ids {
+		if nid == id {
+			r.ids = append(r.ids[:i:i], r.ids[i+1:]...)
+			break
+		}
+	}
+}
+
+func (r *Registry) Node(id utils.ID) (*cn.ChordNode, bool) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	node, present := r.nodes[id]
+	return node, present
+}
+
+func (r *Registry) Host(id utils.ID) (*cn.Host, bool) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	host, present := r.hosts[id]
+	return host, present
+}
+
+func (r *Registry) Daemon(id utils.ID) (*daemon, bool) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	d, present := r.daemons[id]
+	return d, present
+}
+
+func (r *Registry) Address(id utils.ID) (string, bool) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	address, present := r.directory[id]
+	return address, present
+}
+
+func (r *Registry) Ids() []utils.ID {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return append([]utils.ID{}, r.ids...)
+}
+
+func (r *Registry) Nodes() map[utils.ID]*cn.ChordNode {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	nodes := make(map[utils.ID]*cn.ChordNode, len(r.nodes))
+	for id, node := range r.nodes {
+		nodes[id] = node
+	}
+	return nodes
+}
+
+func (r *Registry) Daemons() map[utils.ID]*daemon {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	daemons := make(map[utils.ID]*daemon, len(r.daemons))
+	for id, d := range r.daemons {
+		daemons[id] = d
+	}
+	return daemons
+}
+
+// The ids of the nodes served from the same endpoint as id, id included.
+func (r *Registry) Siblings(id utils.ID) []utils.ID {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	endpoint, _ := utils.SplitVirtual(r.directory[id])
+	siblings := []utils.ID{}
+	for _, nid := range r.ids {
+		if other, _ := utils.SplitVirtual(r.directory[nid]); other == endpoint {
+			siblings = append(siblings, nid)
+		}
+	}
+	return siblings
+}
+
+func (r *Registry) Directory() map[utils.ID]string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	directory := make(map[utils.ID]string, len(r.directory))
+	for id, address := range r.directory {
+		directory[id] = address
+	}
+	return directory
+}
+
+// Width of the ring's id space, for every node we start.
+var Bits = utils.DEFAULT_BITS
 
-// Stores all nodes in the system.
-var nodes map[uint32]*cn.ChordNode
-var nodeIds []uint32
+// Virtual nodes each host we start runs.
+var VirtualNodes = 1
+
+// Path of the chordnode binary. When set, new nodes are started as daemons.
+var chordnodePath string
 
 func getSponsoringNodeAddress() (string, error) {
-	nodes_in_ring := []uint32{}
-	for _, id := range nodeIds {
-		if (*(nodes[id])).InRing {
+	nodes_in_ring := []utils.ID{}
+	for _, id := range registry.Ids() {
+		if inRing(id) {
 			nodes_in_ring = append(nodes_in_ring, id)
 		}
 	}
@@ -39,91 +217,167 @@ func getSponsoringNodeAddress() (string, error) {
 		return "", errors.New("wot")
 	}
 	nid := nodes_in_ring[rand.Intn(len(nodes_in_ring))]
+	address, _ := registry.Address(nid)
 
-	return NodeDirectory[nid], nil
+	return address, nil
 }
 
 func main() {
-	NodeDirectory = map[uint32]string{}
-	nodes = map[uint32]*cn.ChordNode{}
+	flag.StringVar(&chordnodePath, "spawn", "", "path of the chordnode binary; run new nodes as daemons instead of in this process")
+	attach := flag.String("attach", "", "comma separated addresses of running chordnode daemons to manage")
+	flag.IntVar(&Bits, "bits", Bits, "width of the id space; every node in the ring uses it")
+	flag.IntVar(&VirtualNodes, "vnodes", VirtualNodes, "virtual nodes each new host runs")
+	flag.Parse()
+	if err := utils.ValidateBits(Bits); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	if VirtualNodes < 1 {
+		fmt.Fprintln(os.Stderr, "vnodes: need at least one")
+		os.Exit(2)
+	}
+
+	utils.DEBUG = DEBUG
+	for _, address := range strings.Split(*attach, ",") {
+		if address != "" {
+			registry.AddDaemon(&daemon{address: address, vnodes: virtualNodesAt(address)})
+		}
+	}
 	router := mux.NewRouter()
-	go Stabilizer()
-	go CheckPredecessorLoop()
-	go FixFinger()
 	router.HandleFunc("/visualize", VizHandler).Methods("GET")
 	fs := http.FileServer(http.Dir("./static"))
 	router.PathPrefix("/js/").Handler(fs)
 	router.PathPrefix("/css/").Handler(fs)
 	router.HandleFunc("/nodes", NodeHandler).Methods("GET", "POST")
 	router.HandleFunc("/nodes/{count}", MultiNodeHandler).Methods("POST")
+	router.HandleFunc("/nodes/{id}", NodeDeleteHandler).Methods("DELETE")
 	router.HandleFunc("/nodes/{id}/join", NodeJoinHandler).Methods("POST")
 	router.HandleFunc("/nodes/{id}/ping", NodePingHandler).Methods("POST")
 	router.HandleFunc("/nodes/{id}/leave/{mode}", NodeLeaveHandler).Methods("POST")
+	router.HandleFunc("/nodes/{id}/faults", NodeFaultsHandler).Methods("POST")
 	router.HandleFunc("/nodeDirectory", NodeDirectoryHandler).Methods("GET")
+	router.HandleFunc("/lookup/{key}", LookupHandler).Methods("GET")
+	router.HandleFunc("/stats/load", LoadHandler).Methods("GET")
+	router.HandleFunc("/ring/check", RingCheckHandler).Methods("GET")
+	router.HandleFunc("/partition", PartitionHandler).Methods("POST", "DELETE")
 	http.ListenAndServe(":8080", router)
 }
 
-func FixFinger() {
-	for {
-
-		for i := 0; i < len(nodeIds); i++ {
-			address := NodeDirectory[nodeIds[i]]
-			cmd := utils.FixRingFingersCommand()
-			response, err := utils.SendMessage(cmd, address)
-			if err != nil {
-				utils.Debug("[Fix Ring Fingers] unable to stabilize %s\n", fmt.Sprint(nodeIds[i]))
-			} else {
-				utils.Debug("[Fix Ring Fingers] response: %s\n", response)
-			}
-			time.Sleep(FIX_FINGER_TIME * time.Millisecond)
-		}
+// Is the node in a ring? Daemons are asked; unreachable ones count as out.
+func inRing(id utils.ID) bool {
+	if node, present := registry.Node(id); present {
+		return node.IsInRing()
 	}
+	info, err := daemonInfo(id)
+	return err == nil && info.InRing
+}
 
+func daemonInfo(id utils.ID) (*utils.NodeInfoReply, error) {
+	_, present := registry.Daemon(id)
+	address, _ := registry.Address(id)
+	if !present {
+		return nil, errors.New("No such daemon")
+	}
+	response, err := transportFor(address).SendMessage(utils.NodeInfoCommand(), address)
+	if err != nil {
+		return nil, err
+	}
+	var info utils.NodeInfoReply
+	err = utils.DecodeReply(response, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
 }
 
-func Stabilizer() {
-	for {
+// How many virtual nodes the daemon at address runs. One, if it does not say.
+func virtualNodesAt(address string) int {
+	response, err := transportFor(address).SendMessage(utils.NodeInfoCommand(), address)
+	var info utils.NodeInfoReply
+	if err == nil && utils.DecodeReply(response, &info) == nil && info.VirtualNodes > 1 {
+		return info.VirtualNodes
+	}
+	return 1
+}
 
-		for i := 0; i < len(nodeIds); i++ {
-			address := NodeDirectory[nodeIds[i]]
-			cmd := utils.StabilizeRingCommand()
-			response, err := utils.SendMessage(cmd, address)
-			if err != nil {
-				utils.Debug("[Stabilizer] unable to stabilize %s\n", fmt.Sprint(nodeIds[i]))
-			} else {
-				utils.Debug("[Stabilizer] response: %s\n", response)
+// Start a host of VirtualNodes nodes, as a daemon if we were given the
+// chordnode binary. Returns the id of its first node.
+func addNode() (utils.ID, error) {
+	if chordnodePath == "" {
+		host := cn.GenerateRandomHost(VirtualNodes)
+		for _, node := range host.Nodes {
+			node.Codec = WireCodec
+			if err := node.SetBits(Bits); err != nil {
+				return utils.ID{}, err
 			}
-			time.Sleep(STABILIZE_TIME * time.Millisecond)
+			node.Transport = &utils.PartitionTransport{Transport: host.Transport, From: host.GetOwnAddress(), Partition: partition}
 		}
+		registry.AddHost(host)
+		return host.Nodes[0].ID, host.Start(context.Background())
+	}
+	address := fmt.Sprintf("tcp://%s:%d", utils.Localhost, utils.GetRandomPort())
+	cmd := exec.Command(chordnodePath, "-bind", address, "-codec", WireCodec.Name(), "-bits", strconv.Itoa(Bits), "-vnodes", strconv.Itoa(VirtualNodes), fmt.Sprintf("-debug=%t", DEBUG))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return utils.ID{}, err
 	}
+	d := &daemon{address: address, vnodes: VirtualNodes, cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(d.exited)
+	}()
+	return registry.AddDaemon(d), nil
 }
 
-func CheckPredecessorLoop() {
-	for {
-
-		for i := 0; i < len(nodeIds); i++ {
-			address := NodeDirectory[nodeIds[i]]
-			cmd := utils.CheckPredecessorCommand()
-			_, _ = utils.SendMessage(cmd, address)
-			time.Sleep(CHK_PREDECESSOR_TIME * time.Millisecond)
+// What every node we can reach says about itself.
+func nodeInfos() map[utils.ID]*utils.NodeInfoReply {
+	all := map[utils.ID]*utils.NodeInfoReply{}
+	for id, node := range registry.Nodes() {
+		all[id] = node.Info()
+	}
+	for id := range registry.Daemons() {
+		if info, err := daemonInfo(id); err == nil {
+			all[id] = info
 		}
 	}
+	return all
+}
+
+// The endpoint serving the node.
+func hostOf(info *utils.NodeInfoReply) string {
+	return fmt.Sprintf("tcp://%s:%d", info.Address, info.Port)
 }
 
 // API ENDPOINTS
+
+// GET /nodes lists nodes by id. With ?by=host it groups them by the endpoint serving them.
 func NodeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		json.NewEncoder(w).Encode(nodes)
+		all := nodeInfos()
+		if r.URL.Query().Get("by") != "host" {
+			json.NewEncoder(w).Encode(all)
+			return
+		}
+		hosts := map[string]map[utils.ID]*utils.NodeInfoReply{}
+		for id, info := range all {
+			host := hostOf(info)
+			if hosts[host] == nil {
+				hosts[host] = map[utils.ID]*utils.NodeInfoReply{}
+			}
+			hosts[host][id] = info
+		}
+		json.NewEncoder(w).Encode(hosts)
 	} else if r.Method == "POST" {
-		node := cn.GenerateRandomNode(&NodeDirectory)
-		// Add node contact information to directory.
-		NodeDirectory[node.ID] = node.GetOwnAddress()
-		// Add node to global map of nodes.
-		nodes[node.ID] = node
-		nodeIds = append(nodeIds, node.ID)
-		go node.Run()
+		id, err := addNode()
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
 		w.WriteHeader(200)
-		json.NewEncoder(w).Encode(node.ID)
+		json.NewEncoder(w).Encode(id)
 	}
 }
 
@@ -131,13 +385,12 @@ func MultiNodeHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	count, _ := strconv.ParseUint(params["count"], 10, 32)
 	for j := 0; j < int(count); j++ {
-		node := cn.GenerateRandomNode(&NodeDirectory)
-		// Add node contact information to directory.
-		NodeDirectory[node.ID] = node.GetOwnAddress()
-		// Add node to global map of nodes.
-		nodes[node.ID] = node
-		nodeIds = append(nodeIds, node.ID)
-		go node.Run()
+		_, err := addNode()
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
 	}
 	w.WriteHeader(200)
 	json.NewEncoder(w).Encode("Nodes added")
@@ -155,11 +408,11 @@ func VizHandler(w http.ResponseWriter, r *http.Request) {
 
 func NodeJoinHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	id, err := strconv.ParseUint(params["id"], 10, 32)
+	id, err := utils.ParseId(params["id"])
 	if err != nil {
 		// todo error handling
 	}
-	address := NodeDirectory[uint32(id)]
+	address, _ := registry.Address(id)
 	var cmd string
 	sponsorNodeAddr, err := getSponsoringNodeAddress()
 
@@ -170,7 +423,7 @@ func NodeJoinHandler(w http.ResponseWriter, r *http.Request) {
 		utils.Debug("\t\t[SPONSORING_NODE_ADDR] %s\n", sponsorNodeAddr)
 		cmd = utils.JoinRingCommand(sponsorNodeAddr)
 	}
-	response, _ := utils.SendMessage(cmd, address)
+	response, _ := transportFor(address).SendMessage(cmd, address)
 
 	w.WriteHeader(200)
 	json.NewEncoder(w).Encode(response)
@@ -179,14 +432,14 @@ func NodeJoinHandler(w http.ResponseWriter, r *http.Request) {
 
 func NodePingHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	id, err := strconv.ParseUint(params["id"], 10, 32)
+	id, err := utils.ParseId(params["id"])
 	if err != nil {
 		// todo error handling
 	}
-	address := NodeDirectory[uint32(id)]
+	address, _ := registry.Address(id)
 	var cmd string
 	cmd = utils.PingCommand()
-	response, _ := utils.SendMessage(cmd, address)
+	response, _ := transportFor(address).SendMessage(cmd, address)
 
 	w.WriteHeader(200)
 	json.NewEncoder(w).Encode(response)
@@ -194,21 +447,374 @@ func NodePingHandler(w http.ResponseWriter, r *http.Request) {
 }
 func NodeLeaveHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	id, err := strconv.ParseUint(params["id"], 10, 32)
+	id, err := utils.ParseId(params["id"])
 	if err != nil {
 		// todo error handling
 	}
 	mode := params["mode"]
-	address := NodeDirectory[uint32(id)]
+	address, _ := registry.Address(id)
 	cmd := utils.LeaveRingCommand(mode)
-	response, _ := utils.SendMessage(cmd, address)
+	response, _ := transportFor(address).SendMessage(cmd, address)
+
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(response)
+}
 
+/*
+Replace the faults a node injects with the utils.FaultRules in the body, e.g.
+{"drop": 0.2, "latency-ms": 100}. An empty object clears them.
+*/
+func NodeFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := utils.ParseId(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+	address, present := registry.Address(id)
+	if !present {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode("No such node")
+		return
+	}
+	var faults utils.FaultRules
+	if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+	if err := faults.Validate(); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+	response, err := transportFor(address).SendMessage(utils.SetFaultsCommand(faults), address)
+	if err != nil {
+		w.WriteHeader(502)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
 	w.WriteHeader(200)
 	json.NewEncoder(w).Encode(response)
 }
 
 func NodeDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		json.NewEncoder(w).Encode(NodeDirectory)
+		json.NewEncoder(w).Encode(registry.Directory())
+	}
+}
+
+// How evenly something is spread over the hosts.
+type Spread struct {
+	Mean		float64	`json:"mean"`
+	Min		float64	`json:"min"`
+	Max		float64	`json:"max"`
+	MaxOverMean	float64	`json:"max-over-mean"` // 1 when perfectly even.
+	StdDev		float64	`json:"stddev"`
+}
+
+type HostLoad struct {
+	Nodes	int	`json:"nodes"` // Its virtual nodes in the ring.
+	Share	float64	`json:"share"` // Fraction of the id space they are responsible for.
+	Keys	int	`json:"keys"`
+}
+
+type LoadReport struct {
+	Hosts	map[string]*HostLoad	`json:"hosts"`
+	Share	Spread			`json:"share"`
+	Keys	Spread			`json:"keys"`
+}
+
+// How the id space and keys are shared out between the hosts of the nodes in the ring.
+func loadReport(infos map[utils.ID]*utils.NodeInfoReply) *LoadReport {
+	report := &LoadReport{Hosts: map[string]*HostLoad{}}
+	ids := []utils.ID{}
+	for id, info := range infos {
+		if info.InRing {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return report
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Cmp(ids[j]) < 0 })
+	size := new(big.Int).Lsh(big.NewInt(1), uint(infos[ids[0]].Bits))
+	for i, id := range ids {
+		info := infos[id]
+		// Each node is responsible for the ids after its predecessor's, up to its own.
+		share := 1.0
+		if len(ids) > 1 {
+			distance := utils.Distance(ids[(i+len(ids)-1)%len(ids)], id, info.Bits)
+			share, _ = new(big.Rat).SetFrac(distance, size).Float64()
+		}
+		load := report.Hosts[hostOf(info)]
+		if load == nil {
+			load = &HostLoad{}
+			report.Hosts[hostOf(info)] = load
+		}
+		load.Nodes++
+		load.Share += share
+		load.Keys += len(info.Data)
+	}
+	shares, keys := []float64{}, []float64{}
+	for _, load := range report.Hosts {
+		shares = append(shares, load.Share)
+		keys = append(keys, float64(load.Keys))
+	}
+	report.Share = spread(shares)
+	report.Keys = spread(keys)
+	return report
+}
+
+func spread(values []float64) Spread {
+	s := Spread{Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, v := range values {
+		s.Mean += v / float64(len(values))
+		s.Min = math.Min(s.Min, v)
+		s.Max = math.Max(s.Max, v)
+	}
+	for _, v := range values {
+		s.StdDev += (v - s.Mean) * (v - s.Mean) / float64(len(values))
+	}
+	s.StdDev = math.Sqrt(s.StdDev)
+	if s.Mean > 0 {
+		s.MaxOverMean = s.Max / s.Mean
+	}
+	return s
+}
+
+// Report how evenly the id space and keys are spread over the hosts.
+func LoadHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(loadReport(nodeInfos()))
+}
+
+/*
+POST /partition splits the nodes into the groups of ids in the body, e.g.
+[[1234, 5678], [9012]], which then cannot reach each other. Nodes in no group
+reach everyone, and virtual nodes go with their host. DELETE /partition joins
+the groups back up.
+*/
+func PartitionHandler(w http.ResponseWriter, r *http.Request) {
+	groups := [][]utils.ID{}
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&groups); err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+	}
+	addresses := [][]string{}
+	side := map[utils.ID]int{}
+	for i, group := range groups {
+		addresses = append(addresses, []string{})
+		for _, id := range group {
+			address, present := registry.Address(id)
+			if !present {
+				w.WriteHeader(404)
+				json.NewEncoder(w).Encode("No such node " + id.String())
+				return
+			}
+			addresses[i] = append(addresses[i], address)
+			side[id] = i + 1
+		}
+	}
+	partition.Split(addresses...)
+
+	// Daemons send for themselves, and every node's repair must know which
+	// silent peers are only cut off, so each is told which nodes it cannot reach.
+	for _, id := range registry.Ids() {
+		node, local := registry.Node(id)
+		faults := utils.FaultRules{}
+		if local {
+			faults = node.Faults()
+		} else if info, err := daemonInfo(id); err != nil {
+			continue
+		} else if info.Faults != nil {
+			faults = *info.Faults
+		}
+		faults.Partition = nil
+		for other, otherSide := range side {
+			if side[id] != 0 && otherSide != side[id] {
+				faults.Partition = append(faults.Partition, other)
+			}
+		}
+		if local {
+			node.SetFaults(faults)
+			continue
+		}
+		address, _ := registry.Address(id)
+		transportFor(address).SendMessage(utils.SetFaultsCommand(faults), address)
+	}
+	json.NewEncoder(w).Encode(groups)
+}
+
+// Check what every node says about itself against a correct ring of the nodes in it.
+func RingCheckHandler(w http.ResponseWriter, r *http.Request) {
+	infos := []*utils.NodeInfoReply{}
+	for _, info := range nodeInfos() {
+		infos = append(infos, info)
+	}
+	json.NewEncoder(w).Encode(utils.CheckRing(infos))
+}
+
+/*
+Look key up and report every node the lookup went through. ?mode=iterative
+follows the lookup from here, one node at a time; the default is recursive.
+?from=id starts it at that node rather than a random one in the ring.
+*/
+func LookupHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = utils.LOOKUP_RECURSIVE
+	}
+	if mode != utils.LOOKUP_RECURSIVE && mode != utils.LOOKUP_ITERATIVE {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode("Unknown mode " + mode)
+		return
+	}
+	var address string
+	var err error
+	if from := r.URL.Query().Get("from"); from != "" {
+		id, parseErr := utils.ParseId(from)
+		present := false
+		if parseErr == nil {
+			address, present = registry.Address(id)
+		}
+		if !present {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode("No such node")
+			return
+		}
+	} else if address, err = getSponsoringNodeAddress(); err != nil {
+		w.WriteHeader(409)
+		json.NewEncoder(w).Encode("No node is in a ring")
+		return
+	}
+
+	id := utils.ComputeId(key, Bits)
+	reply, err := lookup(id, address, mode)
+	if err != nil {
+		w.WriteHeader(502)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Key	string		`json:"key"`
+		ID	utils.ID	`json:"id"`
+		Mode	string		`json:"mode"`
+		Owner	utils.NodeRef	`json:"owner"`
+		Hops	int		`json:"hops"`
+		Path	[]utils.NodeRef	`json:"path"`
+	}{key, id, mode, reply.Node(), reply.Hops, reply.Path})
+}
+
+// Find the node responsible for id, starting at address and asking each next node
+// in turn, as the first node would.
+func lookup(id utils.ID, address string, mode string) (*utils.FindRingSuccessorReply, error) {
+	var path []utils.NodeRef
+	transport := transportFor(address)
+	for {
+		response, err := transport.SendMessage(utils.LookupCommand(id, address, mode, path), address)
+		if err != nil {
+			return nil, err
+		}
+		var reply utils.FindRingSuccessorReply
+		err = utils.DecodeReply(response, &reply)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Next == nil {
+			return &reply, nil
+		}
+		path = reply.Path
+		address = reply.Next.Address
+	}
+}
+
+/*
+The transport to send with on behalf of the node at address, so that partitions
+split what we send for it just as they split its own requests. That is the
+node's own transport if it runs in this process.
+*/
+func transportFor(address string) utils.Transport {
+	for _, node := range registry.Nodes() {
+		if node.GetOwnAddress() == address {
+			return node.Transport
+		}
+	}
+	return &utils.PartitionTransport{Transport: utils.ZmqTransport{}, From: address, Partition: partition}
+}
+
+// Hand off the keys of the node and every other virtual node on its host, stop
+// the host and forget them all.
+func NodeDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := utils.ParseId(params["id"])
+	host, local := registry.Host(id)
+	d, remote := registry.Daemon(id)
+	if err != nil || !(local || remote) {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode("No such node")
+		return
+	}
+	siblings := registry.Siblings(id)
+	for _, sibling := range siblings {
+		if !inRing(sibling) {
+			continue
+		}
+		address, _ := registry.Address(sibling)
+		response, err := transportFor(address).SendMessage(utils.LeaveRingCommand("orderly"), address)
+		var status utils.StatusReply
+		if err == nil {
+			err = utils.DecodeReply(response, &status)
+		}
+		if err == nil && status.Status != utils.STATUS_OK {
+			err = errors.New(status.Error)
+		}
+		if err != nil {
+			// Stopping now would lose the keys the node could not hand off.
+			w.WriteHeader(409)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+	}
+
+	if local {
+		ctx, cancel := context.WithTimeout(context.Background(), STOP_TIMEOUT)
+		defer cancel()
+		err = host.Stop(ctx)
+	} else if d.cmd != nil {
+		err = stopDaemon(d)
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+	for _, sibling := range siblings {
+		registry.Remove(sibling)
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode("Node deleted")
+}
+
+// Ask a daemon we started to exit, killing it if it takes longer than STOP_TIMEOUT.
+func stopDaemon(d *daemon) error {
+	err := d.cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		select {
+		case <-d.exited:
+			return nil
+		default:
+			return err
+		}
+	}
+	select {
+	case <-d.exited:
+	case <-time.After(STOP_TIMEOUT):
+		d.cmd.Process.Kill()
+		<-d.exited
 	}
+	return nil
 }
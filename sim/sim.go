@@ -0,0 +1,365 @@
+/*
+Package sim runs ChordNode logic on a virtual clock over a simulated network,
+so that experiments with churn are quick and every run with the same seed
+replays identically.
+
+Events, whether scripted joins, leaves and failures or the nodes' own
+maintenance tasks, run one at a time in order of their virtual time. Sending a
+message runs the receiver's handler there and then, moving the clock on by the
+message's delay each way, or by Timeout if the message or its reply is lost.
+That time passes for the nodes taking part in the event, and anything they
+schedule comes after it, but it does not hold up other events: the next event
+starts at its own time. Nothing runs concurrently, so a run depends only on
+the seed and the script.
+*/
+package sim
+
+import (
+	chordnode "chord/chordNode"
+	"chord/utils"
+
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+type Config struct {
+	Seed		int64
+	Delay		time.Duration // One way, for every message.
+	Jitter		time.Duration // Up to this much more delay, at random.
+	Loss		float64 // Chance that a request or its reply goes missing.
+	Timeout		time.Duration // How long a sender waits for a message that went missing.
+	Maintenance	chordnode.MaintenanceConfig // How often each node runs its tasks, in virtual time.
+	Bits		int
+	TraceMessages	bool // Trace every message as well as every event.
+}
+
+var DefaultConfig = Config{
+	Seed:        1,
+	Delay:       5 * time.Millisecond,
+	Jitter:      5 * time.Millisecond,
+	Timeout:     time.Second,
+	Maintenance: chordnode.DefaultMaintenance,
+	Bits:        utils.DEFAULT_BITS,
+}
+
+// Where a scripted event comes in the run, and what it does.
+const (
+	CREATE	= "create" // Node starts a ring.
+	JOIN	= "join" // Node joins the ring through Via.
+	LEAVE	= "leave" // Node hands off its keys and leaves.
+	FAIL	= "fail" // Node stops answering without a word.
+	PUT	= "put" // Key is stored through Node.
+)
+
+/*
+One step of a script. Nodes are numbered in the order AddNodes made them.
+*/
+type Event struct {
+	At	time.Duration	`json:"at"`
+	Do	string		`json:"do"`
+	Node	int		`json:"node"`
+	Via	int		`json:"via,omitempty"`
+	Key	string		`json:"key,omitempty"`
+}
+
+type Simulator struct {
+	config	Config
+	rand	*rand.Rand
+	now	time.Duration
+	queue	eventQueue
+	seq	int
+	nodes	[]*simNode
+	byAddress	map[string]*simNode
+	Trace	[]string // What happened, in order.
+	Sent	int // Messages sent, lost ones included.
+	Lost	int
+}
+
+type simNode struct {
+	node	*chordnode.ChordNode
+	up	bool // False once it has failed or left.
+	tasks	bool // Whether its maintenance tasks are scheduled.
+}
+
+// Fails if config.Bits is not an id space nodes can use.
+func New(config Config) (*Simulator, error) {
+	if err := utils.ValidateBits(config.Bits); err != nil {
+		return nil, err
+	}
+	return &Simulator{
+		config:    config,
+		rand:      rand.New(rand.NewSource(config.Seed)),
+		byAddress: map[string]*simNode{},
+	}, nil
+}
+
+// Virtual time since the run began, as the event running now sees it.
+func (s *Simulator) Elapsed() time.Duration {
+	return s.now
+}
+
+// Make count more nodes, outside any ring, and return them.
+func (s *Simulator) AddNodes(count int) []*chordnode.ChordNode {
+	added := []*chordnode.ChordNode{}
+	for i := 0; i < count; i++ {
+		port := utils.MinPort + len(s.nodes)
+		node := chordnode.New(utils.Localhost, port, &transport{sim: s, from: fmt.Sprintf("tcp://%s:%d", utils.Localhost, port)})
+		// New checked Bits, and the node is in no ring yet, so this cannot fail.
+		node.SetBits(s.config.Bits)
+		node.Maintenance = chordnode.MaintenanceConfig{}
+		node.Clock = clock{s}
+		sn := &simNode{node: node, up: true}
+		s.nodes = append(s.nodes, sn)
+		s.byAddress[node.GetOwnAddress()] = sn
+		added = append(added, node)
+	}
+	return added
+}
+
+// Change the chance of losing a message from now on, e.g. to let the ring
+// settle after a stormy spell.
+func (s *Simulator) SetLoss(loss float64) {
+	s.config.Loss = loss
+}
+
+func (s *Simulator) Node(i int) *chordnode.ChordNode {
+	return s.nodes[i].node
+}
+
+// The nodes that have neither failed nor left and are in the ring.
+func (s *Simulator) Live() []*chordnode.ChordNode {
+	live := []*chordnode.ChordNode{}
+	for _, sn := range s.nodes {
+		if sn.up && sn.node.IsInRing() {
+			live = append(live, sn.node)
+		}
+	}
+	return live
+}
+
+// Run f at virtual time at, after every event already due by then.
+func (s *Simulator) At(at time.Duration, f func()) {
+	if at < s.now {
+		at = s.now
+	}
+	s.seq++
+	heap.Push(&s.queue, &event{at: at, seq: s.seq, run: f})
+}
+
+// Schedule every event of a script.
+func (s *Simulator) Schedule(script []Event) error {
+	for _, e := range script {
+		if e.Node < 0 || e.Node >= len(s.nodes) || e.Via < 0 || e.Via >= len(s.nodes) {
+			return fmt.Errorf("%s at %s: no such node", e.Do, e.At)
+		}
+		e := e
+		switch e.Do {
+		case CREATE, JOIN, LEAVE, FAIL, PUT:
+		default:
+			return fmt.Errorf("%s at %s: unknown event", e.Do, e.At)
+		}
+		s.At(e.At, func() { s.apply(e) })
+	}
+	return nil
+}
+
+func (s *Simulator) apply(e Event) {
+	sn := s.nodes[e.Node]
+	node := sn.node
+	if !sn.up {
+		s.trace("%s node %d: it is down", e.Do, e.Node)
+		return
+	}
+	var result string
+	switch e.Do {
+	case CREATE:
+		result = node.CreateRing().Status
+		s.startTasks(sn)
+	case JOIN:
+		reply := node.JoinRing(s.nodes[e.Via].node.GetOwnAddress())
+		result = reply.Status + " " + reply.Error
+		s.startTasks(sn)
+	case LEAVE:
+		reply := node.LeaveRing("orderly")
+		result = reply.Status + " " + reply.Error
+		if reply.Status == utils.STATUS_OK {
+			sn.up = false
+		}
+	case FAIL:
+		sn.up = false
+		result = "down"
+	case PUT:
+		reply, err := node.Put(e.Key, e.Key)
+		if err != nil {
+			result = err.Error()
+		} else {
+			result = reply.Status
+		}
+	}
+	s.trace("%s node %d (%s): %s", e.Do, e.Node, node.ID, result)
+}
+
+// Run a node's maintenance tasks every so often, in virtual time, until it goes down.
+func (s *Simulator) startTasks(sn *simNode) {
+	if sn.tasks {
+		return
+	}
+	sn.tasks = true
+	config := s.config.Maintenance
+	tasks := []struct {
+		interval	time.Duration
+		run		func()
+	}{
+		{config.Stabilize, func() { sn.node.StabilizeRing() }},
+		{config.CheckPredecessor, sn.node.CheckPredecessor},
+		{config.FixFingers, func() { sn.node.FixRingFingers() }},
+		{config.Replicate, func() { sn.node.ReplicateKeys() }},
+		{config.Repair, func() { sn.node.RepairRing() }},
+	}
+	for _, task := range tasks {
+		if task.interval <= 0 {
+			continue
+		}
+		task := task
+		var tick func()
+		tick = func() {
+			if !sn.up {
+				return
+			}
+			if sn.node.IsInRing() && !sn.node.Faults().Crash {
+				task.run()
+			}
+			s.At(s.now+s.wait(task.interval), tick)
+		}
+		s.At(s.now+s.wait(task.interval), tick)
+	}
+}
+
+// interval, stretched by up to the maintenance jitter.
+func (s *Simulator) wait(interval time.Duration) time.Duration {
+	return interval + time.Duration(s.rand.Float64()*s.config.Maintenance.Jitter*float64(interval))
+}
+
+// Run every event due by until, then move the clock on to it.
+func (s *Simulator) Run(until time.Duration) {
+	for s.queue.Len() > 0 && s.queue[0].at <= until {
+		e := heap.Pop(&s.queue).(*event)
+		s.now = e.at
+		e.run()
+	}
+	s.now = until
+}
+
+/*
+Whether every live node's successor is the next live node around the ring,
+and every predecessor the one before.
+*/
+func (s *Simulator) Converged() bool {
+	live := s.Live()
+	if len(live) == 0 {
+		return true
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].ID.Cmp(live[j].ID) < 0 })
+	for i, node := range live {
+		info := node.Info()
+		next, previous := live[(i+1)%len(live)], live[(i+len(live)-1)%len(live)]
+		if info.Successor == nil || info.Successor.ID != next.ID {
+			return false
+		}
+		if info.Predecessor == nil || info.Predecessor.ID != previous.ID {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Simulator) trace(format string, args ...interface{}) {
+	s.Trace = append(s.Trace, fmt.Sprintf("%s ", s.now)+fmt.Sprintf(format, args...))
+}
+
+func (s *Simulator) delay() time.Duration {
+	delay := s.config.Delay
+	if s.config.Jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(s.config.Jitter)))
+	}
+	return delay
+}
+
+// A node's view of the simulated network.
+type transport struct {
+	sim	*Simulator
+	from	string
+}
+
+func (t *transport) SendMessage(msg string, address string) (string, error) {
+	s := t.sim
+	s.Sent++
+	to, present := s.byAddress[address]
+	lost := s.config.Loss > 0 && s.rand.Float64() < s.config.Loss
+	if lost {
+		s.Lost++
+	}
+	if !present || !to.up || lost {
+		if s.config.TraceMessages {
+			s.trace("%s -> %s lost: %s", t.from, address, msg)
+		}
+		s.now += s.config.Timeout
+		return "", &utils.SendError{Address: address, Attempts: 1, Err: utils.ErrTimeout}
+	}
+	if s.config.TraceMessages {
+		s.trace("%s -> %s: %s", t.from, address, msg)
+	}
+	s.now += s.delay()
+	reply, err := to.node.ProcessIncomingCommand(msg)
+	s.now += s.delay()
+	if err != nil {
+		return "", &utils.SendError{Address: address, Attempts: 1, Err: utils.ErrDropped}
+	}
+	return reply, nil
+}
+
+func (t *transport) SendMessageContext(ctx context.Context, msg string, address string) (string, error) {
+	return t.SendMessage(msg, address)
+}
+
+func (t *transport) Serve(ctx context.Context, address string, handler utils.Handler) error {
+	return errors.New("Simulated nodes are driven by the simulator, not served")
+}
+
+// The simulator's clock, as its nodes see it.
+type clock struct {
+	sim *Simulator
+}
+
+func (c clock) Now() time.Time		{ return time.Unix(0, 0).Add(c.sim.now) }
+func (c clock) Sleep(d time.Duration)	{ c.sim.now += d }
+func (c clock) Go(f func())		{ c.sim.At(c.sim.now, f) }
+
+type event struct {
+	at	time.Duration
+	seq	int // Events due at the same time run in the order they were scheduled.
+	run	func()
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int	{ return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int)		{ q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{})	{ *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
@@ -24,6 +24,11 @@ $(document).ready(function() {
 		$.post($(this)[0].href);
 	});
 
+	$("body").on('click', '.delete-link', function(e) {
+		e.preventDefault();
+		$.ajax($(this)[0].href, {"method":"DELETE"}).done(function(data) {console.log(data) });
+	});
+
 	setInterval(function() {
 		$.get("http://localhost:8080/nodes", function(data) {
 			nodes = JSON.parse(data);
@@ -60,8 +65,7 @@ function drawNodesChart(nodes) {
 	var keys = Object.keys(nodes)
 	for (var i = 0; i < keys.length; i++) {
 		var node = nodes[keys[i]];
-		var max_id = 4294967295;
-		var ratio = node.ID / max_id;
+		var ratio = ringPosition(node.ID, node);
 		var radians = (ratio * 2 * Math.PI) - (Math.PI/2);
 		var y = Math.sin(radians) * radius;
 		var x = Math.cos(radians) * radius;
@@ -71,9 +75,9 @@ function drawNodesChart(nodes) {
 		
 
 		var table = node.Table;
-		for ( var j = 0; j < 32; j++) {
+		for ( var j = 0; j < table.length; j++) {
 			if (node.Table[j] !== null) {
-				var ratio = node.Table[j] / max_id;
+				var ratio = ringPosition(node.Table[j].id, node);
 				var radians = (ratio * 2 * Math.PI) - (Math.PI/2);
 				var sy = Math.sin(radians) * (radius-adjust);
 				var sx = Math.cos(radians) * (radius-adjust);
@@ -86,8 +90,8 @@ function drawNodesChart(nodes) {
 			}
 		}
 		// Draw connecting line.
-		if (node.Successor && node.Successor != 0) {
-			var ratio = node.Successor / max_id;
+		if (node.Successor) {
+			var ratio = ringPosition(node.Successor.id, node);
 			var radians = (ratio * 2 * Math.PI) - (Math.PI/2);
 			var sy = Math.sin(radians) * (radius-adjust);
 			var sx = Math.cos(radians) * (radius-adjust);
@@ -118,11 +122,28 @@ function drawNodesChart(nodes) {
 	}
 }
 
+// Where id lies around the ring of node, from 0 to 1. Ids too big for a
+// number arrive as decimal strings, and Number reads both.
+function ringPosition(id, node) {
+	return Number(id) / Math.pow(2, node.Bits);
+}
+
+// Order ids, which may be decimal strings, numerically.
+function compareIds(a, b) {
+	var x = BigInt(a), y = BigInt(b);
+	return x < y ? -1 : (x > y ? 1 : 0);
+}
+
+// Successor, predecessor and fingers are {id, address} pairs, or null.
+function refId(ref) {
+	return ref ? ref.id : null;
+}
+
 function drawNodesTable(nodes) {
 	var $nodeList = $("#node-list");
 	$nodeList.empty();
 	var table = document.createElement('table')
-	var keys = Object.keys(nodes)
+	var keys = Object.keys(nodes).sort(compareIds)
 
 	// Header.
 	var tr = document.createElement('tr');   
@@ -141,6 +162,11 @@ function drawNodesTable(nodes) {
 	succ_th.appendChild(succ);
     	tr.appendChild(succ_th);
 
+	var succ_list = document.createTextNode("SUCC LIST");
+    	var succ_list_th = document.createElement('th');
+	succ_list_th.appendChild(succ_list);
+    	tr.appendChild(succ_list_th);
+
 	var pred = document.createTextNode("PRED");
     	var pred_th = document.createElement('th');
 	pred_th.appendChild(pred);
@@ -172,12 +198,22 @@ function drawNodesTable(nodes) {
     		id_td.appendChild(id);
     		tr.appendChild(id_td);
 
-    		var succ = document.createTextNode(node.Successor);
+    		var succ = document.createTextNode(refId(node.Successor));
     		var succ_td = document.createElement('td');
     		succ_td.appendChild(succ);
     		tr.appendChild(succ_td);
 
-    		var pred = document.createTextNode(node.Predecessor);
+    		var succ_list_td = document.createElement('td');
+		var succ_list = node.SuccessorList || [];
+		for (var k = 0; k < succ_list.length; k++) {
+			var s_div = document.createElement('div');
+			s_div.className = "finger-div"
+			s_div.appendChild(document.createTextNode(succ_list[k].id));
+			succ_list_td.appendChild(s_div);
+		}
+    		tr.appendChild(succ_list_td);
+
+    		var pred = document.createTextNode(refId(node.Predecessor));
     		var pred_td = document.createElement('td');
     		pred_td.appendChild(pred);
     		tr.appendChild(pred_td);
@@ -185,12 +221,12 @@ function drawNodesTable(nodes) {
 		var fingers = "";
 		var last_found = -1;
     		var fin_td = document.createElement('td');
-		for (var k = 0; k < 32; k++) {
-			if (node.Table[k] !== null && node.Table[k] != last_found) {
+		for (var k = 0; k < node.Table.length; k++) {
+			if (node.Table[k] !== null && node.Table[k].id != last_found) {
 				var t_div = document.createElement('div');
 				t_div.className = "finger-div"
-				last_found = node.Table[k]
-    				var fin = document.createTextNode(node.Table[k]);
+				last_found = node.Table[k].id
+    				var fin = document.createTextNode(node.Table[k].id);
 				t_div.appendChild(fin);
     				fin_td.appendChild(t_div);
 			}
@@ -207,6 +243,7 @@ function drawNodesTable(nodes) {
 
     			var join_link_td = document.createElement('td');
     			join_link_td.appendChild(join_link);
+    			join_link_td.appendChild(createDeleteLink(node));
     			tr.appendChild(join_link_td);
 		} else {
 			var leave_link_container = document.createElement('div')
@@ -226,6 +263,7 @@ function drawNodesTable(nodes) {
 			leave_link.href = "http://localhost:8080/nodes/" + node.ID + "/leave/rude";
 			leave_link.className = "action-link";
 			leave_link_container.appendChild(leave_link)
+			leave_link_container.appendChild(createDeleteLink(node))
 
     			var leave_link_td = document.createElement('td');
     			leave_link_td.appendChild(leave_link_container);
@@ -236,3 +274,13 @@ function drawNodesTable(nodes) {
 	}
 	$nodeList[0].appendChild(table)
 }
+
+function createDeleteLink(node) {
+	var delete_link = document.createElement('a');
+	var delete_link_text = document.createTextNode("Delete");
+	delete_link.appendChild(delete_link_text);
+	delete_link.title = "Delete";
+	delete_link.href = "http://localhost:8080/nodes/" + node.ID;
+	delete_link.className = "delete-link";
+	return delete_link;
+}
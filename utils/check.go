@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+)
+
+// What a Violation breaks.
+const (
+	CHECK_SUCCESSOR		= "successor" // Not the next node in the ring.
+	CHECK_PREDECESSOR	= "predecessor" // Not the previous node in the ring.
+	CHECK_FINGER		= "finger" // Not the first node at or after the finger's start.
+	CHECK_KEY		= "key" // Stored at a node that is not responsible for it.
+	CHECK_BITS		= "bits" // A different id space from the rest of the ring.
+)
+
+type Violation struct {
+	Node	ID	`json:"node"`
+	Check	string	`json:"check"`
+	Detail	string	`json:"detail"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("node %s: %s: %s", v.Node, v.Check, v.Detail)
+}
+
+// The result of checking a snapshot of the ring against its invariants.
+type RingReport struct {
+	OK		bool		`json:"ok"`
+	Nodes		int		`json:"nodes"` // In the ring.
+	Keys		int		`json:"keys"`
+	Violations	[]Violation	`json:"violations"`
+}
+
+/*
+Check what the nodes say about themselves against what a correct ring of the
+nodes that are in it would look like: each node's successor is the next id,
+its predecessor the previous one, every finger the first node at or after its
+start, and every key is stored by the node responsible for it. A lone node may
+have no predecessor; nodes outside the ring are not checked, and pointing at
+one is a violation.
+*/
+func CheckRing(infos []*NodeInfoReply) *RingReport {
+	report := &RingReport{Violations: []Violation{}}
+	ring := []*NodeInfoReply{}
+	for _, info := range infos {
+		if info.InRing {
+			ring = append(ring, info)
+		}
+	}
+	report.Nodes = len(ring)
+	if len(ring) == 0 {
+		report.OK = true
+		return report
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].ID.Cmp(ring[j].ID) < 0 })
+	bits := ring[0].Bits
+	// The first node in the ring at or after id.
+	successorOf := func(id ID) ID {
+		i := sort.Search(len(ring), func(i int) bool { return ring[i].ID.Cmp(id) >= 0 })
+		return ring[i%len(ring)].ID
+	}
+	violate := func(node ID, check string, format string, args ...interface{}) {
+		report.Violations = append(report.Violations, Violation{Node: node, Check: check, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	for i, info := range ring {
+		if info.Bits != bits {
+			violate(info.ID, CHECK_BITS, "uses %d bits, the ring %d", info.Bits, bits)
+			continue
+		}
+		next, previous := ring[(i+1)%len(ring)].ID, ring[(i+len(ring)-1)%len(ring)].ID
+		if info.Successor == nil {
+			violate(info.ID, CHECK_SUCCESSOR, "none, want %s", next)
+		} else if info.Successor.ID != next {
+			violate(info.ID, CHECK_SUCCESSOR, "%s, want %s", info.Successor.ID, next)
+		}
+		if info.Predecessor == nil {
+			if len(ring) > 1 {
+				violate(info.ID, CHECK_PREDECESSOR, "none, want %s", previous)
+			}
+		} else if info.Predecessor.ID != previous {
+			violate(info.ID, CHECK_PREDECESSOR, "%s, want %s", info.Predecessor.ID, previous)
+		}
+		for f, finger := range info.Table {
+			want := successorOf(FingerStart(info.ID, f, bits))
+			if finger == nil {
+				violate(info.ID, CHECK_FINGER, "%d is unset, want %s", f, want)
+			} else if finger.ID != want {
+				violate(info.ID, CHECK_FINGER, "%d is %s, want %s", f, finger.ID, want)
+			}
+		}
+		keys := []string{}
+		for key := range info.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			report.Keys++
+			if owner := successorOf(ComputeId(key, bits)); owner != info.ID {
+				violate(info.ID, CHECK_KEY, "%q belongs to %s", key, owner)
+			}
+		}
+	}
+	report.OK = len(report.Violations) == 0
+	return report
+}
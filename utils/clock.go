@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"time"
+)
+
+/*
+Where a node gets the time, waits, and runs work in the background. Nodes use
+RealClock unless something, like a simulator, substitutes its own.
+*/
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	Go(f func())
+}
+
+type RealClock struct{}
+
+func (RealClock) Now() time.Time		{ return time.Now() }
+func (RealClock) Sleep(d time.Duration)	{ time.Sleep(d) }
+func (RealClock) Go(f func())		{ go f() }
@@ -0,0 +1,563 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+/*
+Writes messages and replies in one wire format. Decode and DecodeReply accept
+either format, so nodes using different codecs still understand each other, and
+a node answers each request in the format it was sent in.
+*/
+type Codec interface {
+	Name() string
+	Encode(m Message) (string, error)
+	Decode(msg string) (Message, error)
+	EncodeReply(reply interface{}) (string, error)
+	DecodeReply(reply string, v interface{}) error
+}
+
+// Human readable, for debugging and for clients such as curl.
+var JSON Codec = jsonCodec{}
+
+// Compact, for ring maintenance traffic.
+var Binary Codec = binaryCodec{}
+
+// First byte of every binary frame. JSON always starts with '{' or whitespace.
+const BINARY_MAGIC = 0xC4
+
+func CodecByName(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return JSON, nil
+	case "binary":
+		return Binary, nil
+	}
+	return nil, errors.New("unknown codec " + name)
+}
+
+// The codec msg was written with.
+func CodecOf(msg string) Codec {
+	if len(msg) > 0 && msg[0] == BINARY_MAGIC {
+		return Binary
+	}
+	return JSON
+}
+
+// Look up the request type for command and check the sender's version allows it.
+func newRequest(command string, version int) (Message, error) {
+	newMessage, present := messageTypes[command]
+	if !present {
+		return nil, &MessageError{Code: ERR_UNKNOWN_COMMAND, Message: "unknown command " + command}
+	}
+	// A newer sender is answered at our version; an older one only for commands it knows.
+	if version < MIN_PROTOCOL_VERSION {
+		return nil, &MessageError{Code: ERR_UNSUPPORTED_VERSION, Message: fmt.Sprintf("protocol version %d is older than %d", version, MIN_PROTOCOL_VERSION)}
+	}
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	if CommandVersion(command) > version {
+		return nil, &MessageError{Code: ERR_INCOMPATIBLE_VERSION, Message: fmt.Sprintf("%s requires protocol version %d, sender speaks %d", command, CommandVersion(command), version)}
+	}
+	return newMessage(), nil
+}
+
+func validate(m Message) (Message, error) {
+	err := m.Validate()
+	if err != nil {
+		return nil, &MessageError{Code: ERR_INVALID, Message: err.Error()}
+	}
+	return m, nil
+}
+
+func isErrorReply(reply interface{}) bool {
+	status, ok := reply.(*StatusReply)
+	return ok && status.Status == STATUS_ERROR
+}
+
+type jsonCodec struct{}
+
+func (c jsonCodec) Name() string {
+	return "json"
+}
+
+// Encode m as a JSON object with its command in "do" and our protocol version.
+func (c jsonCodec) Encode(m Message) (string, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	do, _ := json.Marshal(m.Command())
+	return withHeader(fmt.Sprintf(`"do":%s,"version":%d`, do, PROTOCOL_VERSION), body), nil
+}
+
+func (c jsonCodec) Decode(msg string) (Message, error) {
+	var envelope struct {
+		Do	*string	`json:"do"`
+		Version	*int	`json:"version"`
+	}
+	err := json.Unmarshal([]byte(msg), &envelope)
+	if err != nil {
+		return nil, &MessageError{Code: ERR_MALFORMED, Message: err.Error()}
+	}
+	if envelope.Do == nil {
+		return nil, &MessageError{Code: ERR_MALFORMED, Message: "missing do"}
+	}
+	version := 1
+	if envelope.Version != nil {
+		version = *envelope.Version
+	}
+	m, err := newRequest(strings.TrimSpace(*envelope.Do), version)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(msg), m)
+	if err != nil {
+		return nil, &MessageError{Code: ERR_MALFORMED, Message: err.Error()}
+	}
+	return validate(m)
+}
+
+func (c jsonCodec) EncodeReply(reply interface{}) (string, error) {
+	body, err := json.Marshal(reply)
+	if err != nil {
+		return "", err
+	}
+	return withHeader(fmt.Sprintf(`"version":%d`, PROTOCOL_VERSION), body), nil
+}
+
+func (c jsonCodec) DecodeReply(reply string, v interface{}) error {
+	var status StatusReply
+	err := json.Unmarshal([]byte(reply), &status)
+	if err != nil {
+		return &MessageError{Code: ERR_MALFORMED, Message: err.Error()}
+	}
+	if status.Status == STATUS_ERROR {
+		return &MessageError{Code: status.Code, Message: status.Error}
+	}
+	err = json.Unmarshal([]byte(reply), v)
+	if err != nil {
+		return &MessageError{Code: ERR_MALFORMED, Message: err.Error()}
+	}
+	return nil
+}
+
+// Prepend header fields to a JSON object.
+func withHeader(header string, body []byte) string {
+	if string(body) == "{}" {
+		return "{" + header + "}"
+	}
+	return "{" + header + "," + string(body[1:])
+}
+
+/*
+Binary frames are BINARY_MAGIC, the payload length as a uvarint, then the
+payload. A request payload is the protocol version, the command and the
+request's fields; a reply payload is the version, an error flag and the reply's
+fields. Fields are written in declaration order:
+
+	unsigned integers	uvarint
+	signed integers		zig-zag varint
+	ID			unsigned LEB128 of any length, the same bytes as a
+				uvarint for ids below 2^64
+	bool			one byte
+	float			IEEE 754 bits of the float64 as a uvarint
+	string			uvarint length, then the bytes
+	pointer			one byte for nil or not, then the value
+	slice, map		uvarint count, then the elements (map keys before values)
+	struct			its fields
+
+Encoding a field of any other kind is an error. New fields must be appended to a struct. Readers stop at the end of the payload,
+leaving missing fields zero and ignoring fields they do not know.
+*/
+type binaryCodec struct{}
+
+func (c binaryCodec) Name() string {
+	return "binary"
+}
+
+func (c binaryCodec) Encode(m Message) (string, error) {
+	var payload bytes.Buffer
+	writeUvarint(&payload, PROTOCOL_VERSION)
+	writeString(&payload, m.Command())
+	if err := writeFields(&payload, reflect.ValueOf(m).Elem()); err != nil {
+		return "", err
+	}
+	return frame(payload.Bytes()), nil
+}
+
+func (c binaryCodec) Decode(msg string) (Message, error) {
+	r, err := unframe(msg)
+	if err != nil {
+		return nil, err
+	}
+	version := r.uvarint()
+	command := r.string()
+	if r.err != nil {
+		return nil, &MessageError{Code: ERR_MALFORMED, Message: r.err.Error()}
+	}
+	m, err := newRequest(command, int(version))
+	if err != nil {
+		return nil, err
+	}
+	r.fields(reflect.ValueOf(m).Elem())
+	if r.err != nil {
+		return nil, &MessageError{Code: ERR_MALFORMED, Message: r.err.Error()}
+	}
+	return validate(m)
+}
+
+func (c binaryCodec) EncodeReply(reply interface{}) (string, error) {
+	var payload bytes.Buffer
+	writeUvarint(&payload, PROTOCOL_VERSION)
+	writeBool(&payload, isErrorReply(reply))
+	if err := writeFields(&payload, reflect.ValueOf(reply).Elem()); err != nil {
+		return "", err
+	}
+	return frame(payload.Bytes()), nil
+}
+
+func (c binaryCodec) DecodeReply(reply string, v interface{}) error {
+	r, err := unframe(reply)
+	if err != nil {
+		return err
+	}
+	r.uvarint()
+	failed := r.bool()
+	if failed && r.err == nil {
+		var status StatusReply
+		r.fields(reflect.ValueOf(&status).Elem())
+		if r.err == nil {
+			return &MessageError{Code: status.Code, Message: status.Error}
+		}
+	}
+	if r.err == nil {
+		r.fields(reflect.ValueOf(v).Elem())
+	}
+	if r.err != nil {
+		return &MessageError{Code: ERR_MALFORMED, Message: r.err.Error()}
+	}
+	return nil
+}
+
+func frame(payload []byte) string {
+	var buf bytes.Buffer
+	buf.Grow(len(payload) + 1 + binary.MaxVarintLen64)
+	buf.WriteByte(BINARY_MAGIC)
+	writeUvarint(&buf, uint64(len(payload)))
+	buf.Write(payload)
+	return buf.String()
+}
+
+func unframe(msg string) (*reader, error) {
+	if len(msg) == 0 || msg[0] != BINARY_MAGIC {
+		return nil, &MessageError{Code: ERR_MALFORMED, Message: "not a binary frame"}
+	}
+	r := &reader{data: []byte(msg[1:])}
+	length := r.uvarint()
+	if r.err != nil || length != uint64(len(r.data)-r.pos) {
+		return nil, &MessageError{Code: ERR_MALFORMED, Message: "frame length does not match payload"}
+	}
+	return r, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], x)])
+}
+
+func writeVarint(buf *bytes.Buffer, x int64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutVarint(scratch[:], x)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func writeBool(buf *bytes.Buffer, b bool) {
+	if b {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+func writeFields(buf *bytes.Buffer, v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		if err := writeValue(buf, v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var idType = reflect.TypeOf(ID{})
+
+func writeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Type() == idType {
+		writeId(buf, v.Interface().(ID))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		writeUvarint(buf, v.Uint())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeVarint(buf, v.Int())
+	case reflect.Bool:
+		writeBool(buf, v.Bool())
+	case reflect.Float32, reflect.Float64:
+		writeUvarint(buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		writeString(buf, v.String())
+	case reflect.Ptr:
+		writeBool(buf, !v.IsNil())
+		if !v.IsNil() {
+			return writeValue(buf, v.Elem())
+		}
+	case reflect.Slice:
+		writeUvarint(buf, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := writeValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		writeUvarint(buf, uint64(v.Len()))
+		// Most maps on the wire are key-value items, so skip reflection for those.
+		if items, ok := v.Interface().(map[string]string); ok {
+			for k, value := range items {
+				writeString(buf, k)
+				writeString(buf, value)
+			}
+			return nil
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := writeValue(buf, iter.Key()); err != nil {
+				return err
+			}
+			if err := writeValue(buf, iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return writeFields(buf, v)
+	default:
+		return errors.New("binary codec cannot encode " + v.Type().String())
+	}
+	return nil
+}
+
+func writeId(buf *bytes.Buffer, id ID) {
+	x := id.Big()
+	if x.IsUint64() {
+		writeUvarint(buf, x.Uint64())
+		return
+	}
+	group := new(big.Int)
+	for {
+		b := byte(group.And(x, big.NewInt(0x7f)).Uint64())
+		x.Rsh(x, 7)
+		if x.Sign() == 0 {
+			buf.WriteByte(b)
+			return
+		}
+		buf.WriteByte(b | 0x80)
+	}
+}
+
+// Reads a binary payload. The first error sticks and later reads return zero values.
+type reader struct {
+	data	[]byte
+	pos	int
+	err	error
+}
+
+var errShortPayload = errors.New("payload ended unexpectedly")
+
+func (r *reader) done() bool {
+	return r.err != nil || r.pos >= len(r.data)
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = errShortPayload
+		return 0
+	}
+	r.pos += n
+	return x
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = errShortPayload
+		return 0
+	}
+	r.pos += n
+	return x
+}
+
+func (r *reader) bool() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.pos >= len(r.data) {
+		r.err = errShortPayload
+		return false
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b != 0
+}
+
+// Bytes in the longest id we accept.
+const MAX_ID_BYTES = (MAX_BITS + 6) / 7
+
+func (r *reader) id() ID {
+	groups := []byte{}
+	for r.err == nil {
+		if r.pos >= len(r.data) {
+			r.err = errShortPayload
+		} else if len(groups) == MAX_ID_BYTES {
+			r.err = errors.New("id is longer than the largest id space")
+		} else {
+			b := r.data[r.pos]
+			r.pos++
+			groups = append(groups, b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+	}
+	if r.err != nil {
+		return ID{}
+	}
+	x := new(big.Int)
+	for i := len(groups) - 1; i >= 0; i-- {
+		x.Lsh(x, 7)
+		x.Or(x, big.NewInt(int64(groups[i])))
+	}
+	return IdFromBig(x)
+}
+
+// Read a count, refusing any that could not fit in what is left of the payload.
+func (r *reader) count() int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.data)-r.pos) {
+		r.err = errShortPayload
+		return 0
+	}
+	return int(n)
+}
+
+func (r *reader) string() string {
+	n := r.count()
+	if r.err != nil {
+		return ""
+	}
+	s := string(r.data[r.pos : r.pos+n])
+	r.pos += n
+	return s
+}
+
+// Read the fields of a top-level struct, stopping early at the end of the payload.
+func (r *reader) fields(v reflect.Value) {
+	for i := 0; i < v.NumField() && !r.done(); i++ {
+		r.value(v.Field(i))
+	}
+}
+
+func (r *reader) value(v reflect.Value) {
+	if r.err != nil {
+		return
+	}
+	if v.Type() == idType {
+		v.Set(reflect.ValueOf(r.id()))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x := r.uvarint()
+		if v.OverflowUint(x) {
+			r.err = fmt.Errorf("%d overflows %s", x, v.Type().String())
+			return
+		}
+		v.SetUint(x)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x := r.varint()
+		if v.OverflowInt(x) {
+			r.err = fmt.Errorf("%d overflows %s", x, v.Type().String())
+			return
+		}
+		v.SetInt(x)
+	case reflect.Bool:
+		v.SetBool(r.bool())
+	case reflect.Float32, reflect.Float64:
+		x := math.Float64frombits(r.uvarint())
+		if v.OverflowFloat(x) {
+			r.err = fmt.Errorf("%g overflows %s", x, v.Type().String())
+			return
+		}
+		v.SetFloat(x)
+	case reflect.String:
+		v.SetString(r.string())
+	case reflect.Ptr:
+		if r.bool() {
+			elem := reflect.New(v.Type().Elem())
+			r.value(elem.Elem())
+			v.Set(elem)
+		}
+	case reflect.Slice:
+		n := r.count()
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			r.value(slice.Index(i))
+		}
+		v.Set(slice)
+	case reflect.Map:
+		n := r.count()
+		if v.Type() == reflect.TypeOf(map[string]string{}) {
+			items := make(map[string]string, n)
+			for i := 0; i < n && r.err == nil; i++ {
+				k := r.string()
+				items[k] = r.string()
+			}
+			v.Set(reflect.ValueOf(items))
+			return
+		}
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n && r.err == nil; i++ {
+			k := reflect.New(v.Type().Key()).Elem()
+			r.value(k)
+			value := reflect.New(v.Type().Elem()).Elem()
+			r.value(value)
+			m.SetMapIndex(k, value)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			r.value(v.Field(i))
+		}
+	default:
+		r.err = errors.New("binary codec cannot decode " + v.Type().String())
+	}
+}
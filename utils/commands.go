@@ -1,120 +1,98 @@
 package utils
 
-import (
-	"github.com/Jeffail/gabs"
-)
-
 func CreateRingCommand() string {
-	jsonObj := gabs.New()
-	jsonObj.Set("create-ring", "do")
-	return jsonObj.String()
+	return Encode(&CreateRingRequest{})
 }
 
 func JoinRingCommand(sponsoringNode string) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("join-ring", "do")
-	jsonObj.Set(sponsoringNode, "sponsoring-node")
-	return jsonObj.String()
-
+	return Encode(&JoinRingRequest{SponsoringNode: sponsoringNode})
 }
 func LeaveRingCommand(mode string) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("leave-ring", "do")
-	jsonObj.Set(mode, "mode")
-	return jsonObj.String()
+	return Encode(&LeaveRingRequest{Mode: mode})
 }
 
-func NotifyOrderlyLeaveCommand(leaver uint32, pred *uint32, succ *uint32) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("notify-orderly-leave", "do")
-	jsonObj.Set(leaver, "leaver")
-	if (pred != nil) {
-		jsonObj.Set(*pred, "predecessor")
-	}
-	if (succ != nil) {
-		jsonObj.Set(*succ, "successor")
-	}
-	return jsonObj.String()
+func NotifyOrderlyLeaveCommand(leaver ID, pred *ID, succ *ID) string {
+	return Encode(&NotifyOrderlyLeaveRequest{Leaver: leaver, Predecessor: pred, Successor: succ})
 }
 
-func PutCommand(key string, value string, replyTo string) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("put", "do")
-	jsonObj.Set(key, "data", "key")
-	jsonObj.Set(value, "data", "value")
-	jsonObj.Set(replyTo, "reply-to")
-	return jsonObj.String()
-
+func PutCommand(key string, value string) string {
+	return Encode(&PutRequest{Data: KeyValue{Key: key, Value: value}})
 }
 
-func GetCommand(key string, replyTo string) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("get", "do")
-	jsonObj.Set(key, "data", "key")
-	jsonObj.Set(replyTo, "reply-to")
-	return jsonObj.String()
+func GetCommand(key string) string {
+	return Encode(&GetRequest{Data: KeyValue{Key: key}})
 }
 func InitRingFingersCommand() string {
-	jsonObj := gabs.New()
-	jsonObj.Set("init-ring-fingers", "do")
-	return jsonObj.String()
+	return Encode(&InitRingFingersRequest{})
 }
 func StabilizeRingCommand() string {
-	jsonObj := gabs.New()
-	jsonObj.Set("stabilize-ring", "do")
-	return jsonObj.String()
+	return Encode(&StabilizeRingRequest{})
 }
 func FixRingFingersCommand() string {
-	jsonObj := gabs.New()
-	jsonObj.Set("fix-ring-fingers", "do")
-	return jsonObj.String()
-}
-func getRingFingersCommand(replyTo string) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("get-ring-fingers", "do")
-	jsonObj.Set(replyTo, "reply-to")
-	return jsonObj.String()
-}
-func RingNotifyCommand(id uint32, replyTo string) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("ring-notify", "do")
-	jsonObj.Set(id, "id")
-	jsonObj.Set(replyTo, "reply-to")
-	return jsonObj.String()
+	return Encode(&FixRingFingersRequest{})
+}
+func GetRingFingersCommand() string {
+	return Encode(&GetRingFingersRequest{})
+}
+func GetSuccessorListCommand() string {
+	return Encode(&GetSuccessorListRequest{})
+}
+func RingNotifyCommand(id ID, replyTo string) string {
+	return Encode(&RingNotifyRequest{ID: id, ReplyTo: replyTo})
 }
 func PingCommand() string {
-	jsonObj := gabs.New()
-	jsonObj.Set("ping", "do")
-	return jsonObj.String()
+	return Encode(&PingRequest{})
 }
 func CheckPredecessorCommand() string {
-	jsonObj := gabs.New()
-	jsonObj.Set("check-predecessor", "do")
-	return jsonObj.String()
+	return Encode(&CheckPredecessorRequest{})
 }
 // {"do": "find-ring-successor", "id": id, "reply-to": address}
-func FindRingSuccessorCommand(id uint32, replyTo string) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("find-ring-successor", "do")
-	jsonObj.Set(id, "id")
-	jsonObj.Set(replyTo, "reply-to")
-	return jsonObj.String()
+func FindRingSuccessorCommand(id ID, replyTo string) string {
+	return Encode(&FindRingSuccessorRequest{ID: id, ReplyTo: replyTo})
+}
+// {"do": "find-ring-successor", "id": id, "reply-to": address, "mode": mode, "path": [node, ...]}
+func LookupCommand(id ID, replyTo string, mode string, path []NodeRef) string {
+	return Encode(&FindRingSuccessorRequest{ID: id, ReplyTo: replyTo, Mode: mode, Path: path})
 }
 func FindRingPredecessorCommand() string {
-	jsonObj := gabs.New()
-	jsonObj.Set("find-ring-predecessor", "do")
-	return jsonObj.String()
-}
-func RemoveCommand(key string, replyTo string) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("remove", "do")
-	jsonObj.Set(key, "data", "key")
-	jsonObj.Set(replyTo, "reply-to")
-	return jsonObj.String()
-}
-func ListItemsCommand(replyTo string) string {
-	jsonObj := gabs.New()
-	jsonObj.Set("list-items", "do")
-	jsonObj.Set(replyTo, "reply-to")
-	return jsonObj.String()
+	return Encode(&FindRingPredecessorRequest{})
+}
+func RemoveCommand(key string) string {
+	return Encode(&RemoveRequest{Data: KeyValue{Key: key}})
+}
+func ListItemsCommand() string {
+	return Encode(&ListItemsRequest{})
+}
+func ReplicateKeysCommand() string {
+	return Encode(&ReplicateKeysRequest{})
+}
+// {"do": "replicate", "owner": id, "items": {key: value, ...}}
+func ReplicateCommand(owner ID, items map[string]string) string {
+	return Encode(&ReplicateRequest{Owner: owner, Items: items})
+}
+// {"do": "replicate-delta", "owner": id, "items": {key: value, ...}, "removed": [key, ...]}
+func ReplicateDeltaCommand(owner ID, items map[string]string, removed []string) string {
+	return Encode(&ReplicateDeltaRequest{Owner: owner, Items: items, Removed: removed})
+}
+func GetReplicaCommand(key string) string {
+	return Encode(&GetReplicaRequest{Data: KeyValue{Key: key}})
+}
+// {"do": "transfer-keys", "from": id, "items": {key: value, ...}}
+func TransferKeysCommand(from ID, items map[string]string) string {
+	return Encode(&TransferKeysRequest{From: from, Items: items})
+}
+// {"do": "bulk-put", "from": id, "items": {key: value, ...}}
+func BulkPutCommand(from ID, items map[string]string) string {
+	return Encode(&BulkPutRequest{From: from, Items: items})
+}
+func HelloCommand() string {
+	return Encode(&HelloRequest{Versions: SupportedVersions(), Features: Features})
+}
+// {"do": "node-info"}
+func NodeInfoCommand() string {
+	return Encode(&NodeInfoRequest{})
+}
+// {"do": "set-faults", "faults": {"drop": 0.1, "latency-ms": 50, ...}}
+func SetFaultsCommand(faults FaultRules) string {
+	return Encode(&SetFaultsRequest{Faults: faults})
 }
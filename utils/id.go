@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Width of the identifier space, m, unless a ring chooses otherwise.
+const DEFAULT_BITS = 32
+// SHA-1 has no more bits to give.
+const MAX_BITS = sha1.Size * 8
+
+/*
+A node or key identifier in a ring of m-bit ids, i.e. an integer in [0, 2^m).
+IDs are values: compare them with == or Cmp and use them as map keys.
+
+In JSON an ID is a number, or a decimal string once it is too big for a
+JavaScript number to hold exactly. See Codec for the binary form.
+*/
+type ID struct {
+	bytes	string // Big-endian, without leading zeros, so equal ids have equal bytes.
+}
+
+// IDs below 2^53 are exact as JSON numbers in JavaScript.
+const JSON_NUMBER_BITS = 53
+
+func NewId(x uint64) ID {
+	return IdFromBig(new(big.Int).SetUint64(x))
+}
+
+// x must not be negative.
+func IdFromBig(x *big.Int) ID {
+	return ID{bytes: string(x.Bytes())}
+}
+
+// Parse a decimal id.
+func ParseId(s string) (ID, error) {
+	x, ok := new(big.Int).SetString(s, 10)
+	if !ok || x.Sign() < 0 {
+		return ID{}, fmt.Errorf("invalid id %q", s)
+	}
+	return IdFromBig(x), nil
+}
+
+func ValidateBits(bits int) error {
+	if bits < 1 || bits > MAX_BITS {
+		return fmt.Errorf("id space must be 1 to %d bits, not %d", MAX_BITS, bits)
+	}
+	return nil
+}
+
+func (id ID) Big() *big.Int {
+	return new(big.Int).SetBytes([]byte(id.bytes))
+}
+
+func (id ID) String() string {
+	return id.Big().String()
+}
+
+func (id ID) Cmp(other ID) int {
+	if len(id.bytes) != len(other.bytes) {
+		if len(id.bytes) < len(other.bytes) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(id.bytes, other.bytes)
+}
+
+// (id + x) mod 2^bits
+func (id ID) Add(x *big.Int, bits int) ID {
+	sum := new(big.Int).Add(id.Big(), x)
+	return IdFromBig(sum.Mod(sum, ringSize(bits)))
+}
+
+// Where the ith finger of id starts: (id + 2^i) mod 2^bits.
+func FingerStart(id ID, i int, bits int) ID {
+	return id.Add(new(big.Int).Lsh(big.NewInt(1), uint(i)), bits)
+}
+
+// How far from has to go clockwise to reach to: (to - from) mod 2^bits.
+func Distance(from ID, to ID, bits int) *big.Int {
+	difference := new(big.Int).Sub(to.Big(), from.Big())
+	return difference.Mod(difference, ringSize(bits))
+}
+
+func ringSize(bits int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits))
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	text := id.String()
+	if id.Big().BitLen() > JSON_NUMBER_BITS {
+		text = `"` + text + `"`
+	}
+	return []byte(text), nil
+}
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		text = text[1 : len(text)-1]
+	}
+	parsed, err := ParseId(text)
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// Used for JSON object keys, as in a map from ids to addresses.
+func (id ID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *ID) UnmarshalText(data []byte) error {
+	parsed, err := ParseId(string(data))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+Simulated one-way delays between addresses, for trying routing schemes out
+over MemoryTransport as if the nodes were spread across racks or sites.
+Pairs that were never set take Default.
+*/
+type LatencyMatrix struct {
+	mux	sync.RWMutex
+	delays	map[[2]string]time.Duration
+	Default	time.Duration
+}
+
+func NewLatencyMatrix() *LatencyMatrix {
+	return &LatencyMatrix{delays: map[[2]string]time.Duration{}}
+}
+
+// Set the delay between a and b, in both directions.
+func (m *LatencyMatrix) Set(a string, b string, delay time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.delays[[2]string{a, b}] = delay
+	m.delays[[2]string{b, a}] = delay
+}
+
+func (m *LatencyMatrix) Latency(from string, to string) time.Duration {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if delay, present := m.delays[[2]string{from, to}]; present {
+		return delay
+	}
+	return m.Default
+}
+
+/*
+Transport for the node at From that holds each request and its reply back by
+the latency between From and the destination.
+*/
+type LatencyTransport struct {
+	Transport
+	From	string
+	Matrix	*LatencyMatrix
+}
+
+// As with PartitionTransport, the wrapped SendMessage times each attempt itself.
+func (t *LatencyTransport) SendMessage(msg string, address string) (string, error) {
+	t.delay(context.Background(), t.From, address)
+	reply, err := t.Transport.SendMessage(msg, address)
+	t.delay(context.Background(), address, t.From)
+	return reply, err
+}
+
+func (t *LatencyTransport) SendMessageContext(ctx context.Context, msg string, address string) (string, error) {
+	if t.delay(ctx, t.From, address) != nil {
+		return "", &SendError{Address: address, Attempts: 1, Err: ErrTimeout}
+	}
+	reply, err := t.Transport.SendMessageContext(ctx, msg, address)
+	if err == nil && t.delay(ctx, address, t.From) != nil {
+		return "", &SendError{Address: address, Attempts: 1, Err: ErrTimeout}
+	}
+	return reply, err
+}
+
+// Wait out the latency from one address to another, unless ctx is done first.
+func (t *LatencyTransport) delay(ctx context.Context, from string, to string) error {
+	timer := time.NewTimer(t.Matrix.Latency(from, to))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
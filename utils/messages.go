@@ -0,0 +1,552 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Version of the protocol spoken by this build, and the oldest version it
+// still accepts. Messages without a version predate versioning and count as 1.
+const PROTOCOL_VERSION = 2
+const MIN_PROTOCOL_VERSION = 1
+
+// Optional capabilities exchanged in the hello handshake.
+const FEATURE_BATCHING = "batching"
+const FEATURE_REPLICATION = "replication"
+const FEATURE_REPLICA_DELTAS = "replica-deltas"
+
+var Features = []string{FEATURE_BATCHING, FEATURE_REPLICATION, FEATURE_REPLICA_DELTAS}
+
+// Protocol version that introduced each command. Anything missing is version 1,
+// including hello, which must work whatever the sender speaks.
+var commandVersions = map[string]int{
+	"get-successor-list": 2,
+	"replicate-keys":     2,
+	"replicate":          2,
+	"replicate-delta":    2,
+	"get-replica":        2,
+	"transfer-keys":      2,
+	"bulk-put":           2,
+	"node-info":          2,
+	"set-faults":         2,
+}
+
+func CommandVersion(command string) int {
+	if version, present := commandVersions[command]; present {
+		return version
+	}
+	return 1
+}
+
+// Error codes carried in StatusReply.Code.
+const ERR_MALFORMED = "malformed"
+const ERR_UNKNOWN_COMMAND = "unknown-command"
+const ERR_INVALID = "invalid"
+const ERR_INTERNAL = "internal"
+const ERR_UNSUPPORTED_VERSION = "unsupported-version"  // The sender's version is too old.
+const ERR_INCOMPATIBLE_VERSION = "incompatible-version" // The command is newer than the sender's version.
+
+const STATUS_ERROR = "error"
+const STATUS_FAILURE = "failure"
+
+/*
+A request sent between nodes. In JSON it is an object whose "do" field names the
+command, e.g. {"do": "find-ring-successor", "id": 42, "reply-to": "tcp://..."}.
+See Codec for the binary form.
+*/
+type Message interface {
+	Command() string
+	Validate() error
+}
+
+/*
+Returned by Decode and carried back to the sender in a StatusReply.
+*/
+type MessageError struct {
+	Code	string
+	Message	string
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// A key and, for writes, its value.
+type KeyValue struct {
+	Key	string	`json:"key"`
+	Value	string	`json:"value,omitempty"`
+}
+
+func (kv KeyValue) validate() error {
+	if kv.Key == "" {
+		return errors.New("missing data.key")
+	}
+	return nil
+}
+
+// A node and the address it serves on.
+type NodeRef struct {
+	ID	ID	`json:"id"`
+	Address	string	`json:"address"`
+}
+
+type CreateRingRequest struct{}
+
+type JoinRingRequest struct {
+	SponsoringNode	string	`json:"sponsoring-node"`
+}
+
+type LeaveRingRequest struct {
+	Mode	string	`json:"mode"`
+}
+
+type NotifyOrderlyLeaveRequest struct {
+	Leaver			ID	`json:"leaver"`
+	Predecessor		*ID	`json:"predecessor,omitempty"`
+	Successor		*ID	`json:"successor,omitempty"`
+	PredecessorAddress	string	`json:"predecessor-address,omitempty"`
+	SuccessorAddress	string	`json:"successor-address,omitempty"`
+}
+
+// The leaver's neighbours, or nil where the sender did not give an address.
+func (m *NotifyOrderlyLeaveRequest) Neighbours() (*NodeRef, *NodeRef) {
+	var pred, succ *NodeRef
+	if m.Predecessor != nil && m.PredecessorAddress != "" {
+		pred = &NodeRef{ID: *m.Predecessor, Address: m.PredecessorAddress}
+	}
+	if m.Successor != nil && m.SuccessorAddress != "" {
+		succ = &NodeRef{ID: *m.Successor, Address: m.SuccessorAddress}
+	}
+	return pred, succ
+}
+
+type PutRequest struct {
+	Data	KeyValue	`json:"data"`
+}
+
+type GetRequest struct {
+	Data	KeyValue	`json:"data"`
+}
+
+type RemoveRequest struct {
+	Data	KeyValue	`json:"data"`
+}
+
+type ListItemsRequest struct{}
+
+type InitRingFingersRequest struct{}
+
+type StabilizeRingRequest struct{}
+
+type FixRingFingersRequest struct{}
+
+type GetRingFingersRequest struct {
+	ReplyTo	string	`json:"reply-to,omitempty"`
+}
+
+type RingNotifyRequest struct {
+	ID	ID	`json:"id"`
+	ReplyTo	string	`json:"reply-to"`
+}
+
+type PingRequest struct{}
+
+type CheckPredecessorRequest struct{}
+
+type FindRingSuccessorRequest struct {
+	ID	ID		`json:"id"`
+	ReplyTo	string		`json:"reply-to"`
+	Mode	string		`json:"mode,omitempty"` // LOOKUP_RECURSIVE, the default, or LOOKUP_ITERATIVE.
+	Path	[]NodeRef	`json:"path,omitempty"` // Nodes the lookup has been through so far.
+}
+
+/*
+How a lookup travels. Recursively, each node passes the request on to the next
+and the answer comes back along the chain. Iteratively, each node only says who
+to ask next, and the node that started the lookup does the asking.
+*/
+const LOOKUP_RECURSIVE = "recursive"
+const LOOKUP_ITERATIVE = "iterative"
+
+type FindRingPredecessorRequest struct{}
+
+type GetSuccessorListRequest struct{}
+
+type ReplicateKeysRequest struct{}
+
+type ReplicateRequest struct {
+	Owner	ID			`json:"owner"`
+	Items	map[string]string	`json:"items"`
+}
+
+// Changes to the replicas held for owner: items to set and keys to delete.
+type ReplicateDeltaRequest struct {
+	Owner	ID			`json:"owner"`
+	Items	map[string]string	`json:"items"`
+	Removed	[]string		`json:"removed"`
+}
+
+type GetReplicaRequest struct {
+	Data	KeyValue	`json:"data"`
+}
+
+type TransferKeysRequest struct {
+	From	ID			`json:"from"`
+	Items	map[string]string	`json:"items"`
+}
+
+type BulkPutRequest struct {
+	From	ID			`json:"from"`
+	Items	map[string]string	`json:"items"`
+}
+
+type NodeInfoRequest struct{}
+
+type SetFaultsRequest struct {
+	Faults	FaultRules	`json:"faults"`
+}
+
+/*
+Faults a node injects into its own traffic, to exercise recovery on purpose.
+The zero value injects none.
+*/
+type FaultRules struct {
+	Drop		float64	`json:"drop,omitempty"` // Fraction of requests to refuse, from 0 to 1.
+	LatencyMs	int	`json:"latency-ms,omitempty"` // How long to hold each reply back.
+	Partition	[]ID	`json:"partition,omitempty"` // Peers our requests cannot reach. Give each side the other for a two-way split.
+	Corrupt		float64	`json:"corrupt,omitempty"` // Fraction of replies to garble, from 0 to 1.
+	Crash		bool	`json:"crash,omitempty"` // Neither answer nor send anything, without telling anyone.
+}
+
+func (f *FaultRules) Validate() error {
+	if f.Drop < 0 || f.Drop > 1 || f.Corrupt < 0 || f.Corrupt > 1 {
+		return errors.New("drop and corrupt must be between 0 and 1")
+	}
+	if f.LatencyMs < 0 {
+		return errors.New("latency-ms must not be negative")
+	}
+	return nil
+}
+
+type HelloRequest struct {
+	Versions	[]int		`json:"versions"`
+	Features	[]string	`json:"features"`
+	Bits		int		`json:"bits,omitempty"` // The sender's id space, if it is a node.
+}
+
+func (m *CreateRingRequest) Command() string          { return "create-ring" }
+func (m *JoinRingRequest) Command() string            { return "join-ring" }
+func (m *LeaveRingRequest) Command() string           { return "leave-ring" }
+func (m *NotifyOrderlyLeaveRequest) Command() string  { return "notify-orderly-leave" }
+func (m *PutRequest) Command() string                 { return "put" }
+func (m *GetRequest) Command() string                 { return "get" }
+func (m *RemoveRequest) Command() string              { return "remove" }
+func (m *ListItemsRequest) Command() string           { return "list-items" }
+func (m *InitRingFingersRequest) Command() string     { return "init-ring-fingers" }
+func (m *StabilizeRingRequest) Command() string       { return "stabilize-ring" }
+func (m *FixRingFingersRequest) Command() string      { return "fix-ring-fingers" }
+func (m *GetRingFingersRequest) Command() string      { return "get-ring-fingers" }
+func (m *RingNotifyRequest) Command() string          { return "ring-notify" }
+func (m *PingRequest) Command() string                { return "ping" }
+func (m *CheckPredecessorRequest) Command() string    { return "check-predecessor" }
+func (m *FindRingSuccessorRequest) Command() string   { return "find-ring-successor" }
+func (m *FindRingPredecessorRequest) Command() string { return "find-ring-predecessor" }
+func (m *GetSuccessorListRequest) Command() string    { return "get-successor-list" }
+func (m *ReplicateKeysRequest) Command() string       { return "replicate-keys" }
+func (m *ReplicateRequest) Command() string           { return "replicate" }
+func (m *ReplicateDeltaRequest) Command() string      { return "replicate-delta" }
+func (m *GetReplicaRequest) Command() string          { return "get-replica" }
+func (m *TransferKeysRequest) Command() string        { return "transfer-keys" }
+func (m *BulkPutRequest) Command() string             { return "bulk-put" }
+func (m *HelloRequest) Command() string               { return "hello" }
+func (m *NodeInfoRequest) Command() string            { return "node-info" }
+func (m *SetFaultsRequest) Command() string           { return "set-faults" }
+
+func (m *CreateRingRequest) Validate() error          { return nil }
+func (m *ListItemsRequest) Validate() error           { return nil }
+func (m *InitRingFingersRequest) Validate() error     { return nil }
+func (m *StabilizeRingRequest) Validate() error       { return nil }
+func (m *FixRingFingersRequest) Validate() error      { return nil }
+func (m *GetRingFingersRequest) Validate() error      { return nil }
+func (m *PingRequest) Validate() error                { return nil }
+func (m *CheckPredecessorRequest) Validate() error    { return nil }
+func (m *FindRingPredecessorRequest) Validate() error { return nil }
+func (m *GetSuccessorListRequest) Validate() error    { return nil }
+func (m *ReplicateKeysRequest) Validate() error       { return nil }
+func (m *NodeInfoRequest) Validate() error            { return nil }
+func (m *NotifyOrderlyLeaveRequest) Validate() error  { return nil }
+func (m *PutRequest) Validate() error                 { return m.Data.validate() }
+func (m *GetRequest) Validate() error                 { return m.Data.validate() }
+func (m *RemoveRequest) Validate() error              { return m.Data.validate() }
+func (m *GetReplicaRequest) Validate() error          { return m.Data.validate() }
+func (m *SetFaultsRequest) Validate() error           { return m.Faults.Validate() }
+
+func (m *JoinRingRequest) Validate() error {
+	if m.SponsoringNode == "" {
+		return errors.New("missing sponsoring-node")
+	}
+	return nil
+}
+
+func (m *LeaveRingRequest) Validate() error {
+	if m.Mode == "" {
+		return errors.New("missing mode")
+	}
+	return nil
+}
+
+func (m *FindRingSuccessorRequest) Validate() error {
+	if m.Mode != "" && m.Mode != LOOKUP_RECURSIVE && m.Mode != LOOKUP_ITERATIVE {
+		return errors.New("unknown mode " + m.Mode)
+	}
+	return nil
+}
+
+func (m *RingNotifyRequest) Validate() error {
+	if m.ReplyTo == "" {
+		return errors.New("missing reply-to")
+	}
+	return nil
+}
+
+func (m *ReplicateRequest) Validate() error {
+	if m.Items == nil {
+		m.Items = map[string]string{}
+	}
+	return nil
+}
+
+func (m *ReplicateDeltaRequest) Validate() error {
+	if m.Items == nil {
+		m.Items = map[string]string{}
+	}
+	return nil
+}
+
+func (m *TransferKeysRequest) Validate() error {
+	if m.Items == nil {
+		m.Items = map[string]string{}
+	}
+	return nil
+}
+
+func (m *HelloRequest) Validate() error {
+	if len(m.Versions) == 0 {
+		return errors.New("missing versions")
+	}
+	return nil
+}
+
+func (m *BulkPutRequest) Validate() error {
+	if m.Items == nil {
+		m.Items = map[string]string{}
+	}
+	return nil
+}
+
+// Constructors for every known command, keyed by "do".
+var messageTypes = map[string]func() Message{}
+
+func init() {
+	for _, m := range []Message{
+		&CreateRingRequest{}, &JoinRingRequest{}, &LeaveRingRequest{},
+		&NotifyOrderlyLeaveRequest{}, &PutRequest{}, &GetRequest{},
+		&RemoveRequest{}, &ListItemsRequest{}, &InitRingFingersRequest{},
+		&StabilizeRingRequest{}, &FixRingFingersRequest{}, &GetRingFingersRequest{},
+		&RingNotifyRequest{}, &PingRequest{}, &CheckPredecessorRequest{},
+		&FindRingSuccessorRequest{}, &FindRingPredecessorRequest{},
+		&GetSuccessorListRequest{}, &ReplicateKeysRequest{}, &ReplicateRequest{},
+		&ReplicateDeltaRequest{}, &GetReplicaRequest{}, &TransferKeysRequest{}, &BulkPutRequest{},
+		&HelloRequest{}, &NodeInfoRequest{}, &SetFaultsRequest{},
+	} {
+		registerMessage(m)
+	}
+}
+
+func registerMessage(m Message) {
+	typ := reflect.TypeOf(m).Elem()
+	messageTypes[m.Command()] = func() Message {
+		return reflect.New(typ).Interface().(Message)
+	}
+}
+
+// Encode m as JSON. Nodes use their own Codec; this is for clients and tests,
+// whose messages are known to encode, so it panics if m does not.
+func Encode(m Message) string {
+	msg, err := JSON.Encode(m)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// Parse and validate a request in either format. Errors are always a *MessageError.
+func Decode(msg string) (Message, error) {
+	return CodecOf(msg).Decode(msg)
+}
+
+/*
+Reply to commands that only report an outcome. Status is "ok", "failure" or
+"error"; errors carry a Code.
+*/
+type StatusReply struct {
+	Status	string	`json:"status"`
+	Message	string	`json:"message,omitempty"`
+	Code	string	`json:"code,omitempty"`
+	Error	string	`json:"error,omitempty"`
+}
+
+// Reply to put, get, remove and get-replica.
+type KeyReply struct {
+	Status	string	`json:"status"`
+	Key	string	`json:"key"`
+	Value	*string	`json:"value,omitempty"`
+}
+
+// Reply to list-items.
+type ItemsReply struct {
+	Status	string			`json:"status"`
+	Items	map[string]string	`json:"items"`
+}
+
+// Reply to bulk-put.
+type CountReply struct {
+	Status	string	`json:"status"`
+	Count	int	`json:"count"`
+}
+
+/*
+Reply to find-ring-successor: the node responsible for the id, the nodes the
+lookup went through, starting with the one that began it, and the number of hops
+between them. A step of an iterative lookup that did not reach the answer gives
+the node to ask next in Next instead. Nodes older than these fields leave out
+Path and Hops, though they speak the same protocol version.
+*/
+type FindRingSuccessorReply struct {
+	ID	ID		`json:"id"`
+	Address	string		`json:"address"`
+	Path	[]NodeRef	`json:"path,omitempty"`
+	Hops	int		`json:"hops,omitempty"`
+	Next	*NodeRef	`json:"next,omitempty"`
+}
+
+func (r *FindRingSuccessorReply) Node() NodeRef {
+	return NodeRef{ID: r.ID, Address: r.Address}
+}
+
+// Reply to find-ring-predecessor. ID is nil when the node has no predecessor.
+type PredecessorReply struct {
+	ID	*ID	`json:"id,omitempty"`
+	Address	string	`json:"address,omitempty"`
+}
+
+// The predecessor, or nil if there is none or its address is unknown.
+func (r *PredecessorReply) Node() *NodeRef {
+	if r.ID == nil || r.Address == "" {
+		return nil
+	}
+	return &NodeRef{ID: *r.ID, Address: r.Address}
+}
+
+// Reply to get-successor-list. Successors repeats the ids in Nodes for version 2 peers.
+type SuccessorListReply struct {
+	Successors	[]ID		`json:"successors"`
+	Nodes		[]NodeRef	`json:"nodes"`
+}
+
+/*
+Reply to node-info: the node's view of the ring. Field names match the JSON of a
+ChordNode, so the visualizer can draw nodes in other processes.
+*/
+type NodeInfoReply struct {
+	ID		ID
+	Address		string
+	Port		int
+	InRing		bool
+	Predecessor	*NodeRef
+	Successor	*NodeRef
+	SuccessorList	[]NodeRef
+	Table		[]*NodeRef
+	Data		map[string]string
+	Bits		int
+	Virtual		int `json:",omitempty"` // Which of its host's virtual nodes this is.
+	VirtualNodes	int `json:",omitempty"` // How many its host runs, if more than one.
+	Faults		*FaultRules `json:",omitempty"` // The faults it injects, if any.
+	Suspects	map[string]string `json:",omitempty"` // Neighbours it doubts are up, by address: suspect or dead.
+}
+
+// Reply to get-ring-fingers: one entry per bit of the id space.
+type FingersReply struct {
+	Bits	int		`json:"bits"`
+	Fingers	[]Finger	`json:"fingers"`
+}
+
+// The first node at or after Start, or nil while that is not yet known.
+type Finger struct {
+	Start	ID		`json:"start"`
+	Node	*NodeRef	`json:"node"`
+}
+
+// Reply to hello: the version both sides will speak and the features both support.
+type HelloReply struct {
+	Version		int		`json:"version"`
+	Features	[]string	`json:"features"`
+	Bits		int		`json:"bits,omitempty"` // Our id space. Nodes older than this field use 32 bits.
+}
+
+// Answer a hello with the highest version and the features we share with the sender.
+func NegotiateHello(request *HelloRequest) (*HelloReply, error) {
+	reply := HelloReply{Features: []string{}}
+	for _, version := range request.Versions {
+		if version >= MIN_PROTOCOL_VERSION && version <= PROTOCOL_VERSION && version > reply.Version {
+			reply.Version = version
+		}
+	}
+	if reply.Version == 0 {
+		return nil, &MessageError{Code: ERR_UNSUPPORTED_VERSION, Message: fmt.Sprintf("no common protocol version, we speak %d to %d", MIN_PROTOCOL_VERSION, PROTOCOL_VERSION)}
+	}
+	for _, feature := range request.Features {
+		for _, ours := range Features {
+			if feature == ours {
+				reply.Features = append(reply.Features, feature)
+			}
+		}
+	}
+	return &reply, nil
+}
+
+// The versions we can speak, for a hello request.
+func SupportedVersions() []int {
+	versions := []int{}
+	for version := MIN_PROTOCOL_VERSION; version <= PROTOCOL_VERSION; version++ {
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+func OkReply(message string) *StatusReply {
+	return &StatusReply{Status: STATUS_OK, Message: message}
+}
+
+func ErrorReply(code string, message string) *StatusReply {
+	return &StatusReply{Status: STATUS_ERROR, Code: code, Error: message}
+}
+
+func FailureReply(err error) *StatusReply {
+	return &StatusReply{Status: STATUS_FAILURE, Error: err.Error()}
+}
+
+func EncodeReply(reply interface{}) string {
+	msg, err := JSON.EncodeReply(reply)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// Parse a reply in either format into v. A StatusReply with status "error" is
+// returned as a *MessageError.
+func DecodeReply(reply string, v interface{}) error {
+	return CodecOf(reply).DecodeReply(reply, v)
+}
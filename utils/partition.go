@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+Splits the network into sides that cannot reach each other, for trying out
+what the ring does when it is cut in two and later joined up again. Sides are
+made of endpoint addresses, so virtual nodes are on their host's side.
+Addresses on no side reach everyone.
+*/
+type Partition struct {
+	mux	sync.RWMutex
+	sides	map[string]int
+}
+
+func NewPartition() *Partition {
+	return &Partition{sides: map[string]int{}}
+}
+
+// Put each group of addresses on a side of its own, replacing any earlier split.
+func (p *Partition) Split(groups ...[]string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.sides = map[string]int{}
+	for side, group := range groups {
+		for _, address := range group {
+			endpoint, _ := SplitVirtual(address)
+			p.sides[endpoint] = side + 1
+		}
+	}
+}
+
+// Join every side back up.
+func (p *Partition) Heal() {
+	p.Split()
+}
+
+// Whether a message from one address cannot get to the other.
+func (p *Partition) Blocks(from string, to string) bool {
+	from, _ = SplitVirtual(from)
+	to, _ = SplitVirtual(to)
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	fromSide, toSide := p.sides[from], p.sides[to]
+	return fromSide != 0 && toSide != 0 && fromSide != toSide
+}
+
+/*
+Transport for the node at From whose requests time out when Partition puts
+their destination on another side.
+*/
+type PartitionTransport struct {
+	Transport
+	From		string
+	Partition	*Partition
+}
+
+// The wrapped transport's SendMessage applies its own timeout to each attempt,
+// so it is called rather than SendMessageContext under a single deadline.
+func (t *PartitionTransport) SendMessage(msg string, address string) (string, error) {
+	if t.Partition.Blocks(t.From, address) {
+		return "", &SendError{Address: address, Attempts: 1, Err: ErrTimeout}
+	}
+	return t.Transport.SendMessage(msg, address)
+}
+
+func (t *PartitionTransport) SendMessageContext(ctx context.Context, msg string, address string) (string, error) {
+	if t.Partition.Blocks(t.From, address) {
+		return "", &SendError{Address: address, Attempts: 1, Err: ErrTimeout}
+	}
+	return t.Transport.SendMessageContext(ctx, msg, address)
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// The peer did not reply before the deadline.
+var ErrTimeout = errors.New("Timed out waiting for reply")
+
+// The peer replied with ERROR_MSG, i.e. it refused or could not handle the request.
+var ErrDropped = errors.New("Dropped Message")
+
+/*
+Returned by SendMessage when no reply could be obtained. Use errors.Is with
+ErrTimeout or ErrDropped to tell the failures apart.
+*/
+type SendError struct {
+	Address		string
+	Attempts	int
+	Err		error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("send to %s failed after %d attempt(s): %s", e.Address, e.Attempts, e.Err.Error())
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+type SendOptions struct {
+	Timeout	time.Duration // Per attempt.
+	Retries	int           // Attempts after the first one.
+	Backoff	time.Duration // Delay before the first retry, doubled after each one.
+}
+
+// Used by SendMessage and by transports that are not given explicit options.
+var DefaultSendOptions = SendOptions{
+	Timeout: 2 * time.Second,
+	Retries: 2,
+	Backoff: 50 * time.Millisecond,
+}
+
+// Idle sockets kept per destination.
+const MAX_IDLE_SOCKETS = 4
+
+// How often a blocked receive checks for cancellation.
+const POLL_INTERVAL = 100 * time.Millisecond
+
+/*
+Cache of connected DEALER sockets, keyed by destination. A socket is only ever
+used by one sender at a time.
+*/
+type socketPool struct {
+	mux	sync.Mutex
+	context	*zmq.Context
+	idle	map[string][]*zmq.Socket
+}
+
+var pool = &socketPool{idle: map[string][]*zmq.Socket{}}
+
+func (p *socketPool) get(address string) (*zmq.Socket, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if sockets := p.idle[address]; len(sockets) > 0 {
+		socket := sockets[len(sockets)-1]
+		p.idle[address] = sockets[:len(sockets)-1]
+		return socket, nil
+	}
+	if p.context == nil {
+		context, err := zmq.NewContext()
+		if err != nil {
+			return nil, err
+		}
+		p.context = context
+	}
+	socket, err := p.context.NewSocket(zmq.DEALER)
+	if err != nil {
+		return nil, err
+	}
+	socket.SetLinger(0)
+	SetId(socket)
+	err = socket.Connect(address)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return socket, nil
+}
+
+func (p *socketPool) put(address string, socket *zmq.Socket) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if len(p.idle[address]) >= MAX_IDLE_SOCKETS {
+		socket.Close()
+		return
+	}
+	p.idle[address] = append(p.idle[address], socket)
+}
+
+// Send msg to address with DefaultSendOptions. This goes straight over ZeroMQ,
+// whatever a Partition says; send for a node through its Transport instead.
+func SendMessage(msg string, address string) (string, error) {
+	return SendMessageContext(context.Background(), msg, address, DefaultSendOptions)
+}
+
+// Send msg to address, retrying on timeouts until ctx is done.
+func SendMessageContext(ctx context.Context, msg string, address string, opts SendOptions) (string, error) {
+	Debug("[SendMessage] Sending msg: %s to address: %s\n", msg, address)
+	backoff := opts.Backoff
+	var err error
+	attempt := 0
+	for attempt <= opts.Retries {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return "", &SendError{Address: address, Attempts: attempt, Err: ctx.Err()}
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		attempt++
+		var reply string
+		reply, err = sendOnce(ctx, msg, address, opts.Timeout)
+		if err == nil {
+			return reply, nil
+		}
+		// The peer answered, so asking again will not help.
+		if errors.Is(err, ErrDropped) {
+			break
+		}
+	}
+	return "", &SendError{Address: address, Attempts: attempt, Err: err}
+}
+
+func sendOnce(ctx context.Context, msg string, address string, timeout time.Duration) (string, error) {
+	endpoint, msg := tagVirtual(address, msg)
+	socket, err := pool.get(endpoint)
+	if err != nil {
+		return "", err
+	}
+	_, err = socket.SendMessage(msg)
+	if err != nil {
+		socket.Close()
+		return "", err
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	poller := zmq.NewPoller()
+	poller.Add(socket, zmq.POLLIN)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 || ctx.Err() != nil {
+			// A late reply would be read by the next sender, so never reuse this socket.
+			socket.Close()
+			if ctx.Err() != nil && remaining > 0 {
+				return "", ctx.Err()
+			}
+			return "", ErrTimeout
+		}
+		if remaining > POLL_INTERVAL {
+			remaining = POLL_INTERVAL
+		}
+		polled, err := poller.Poll(remaining)
+		if err != nil {
+			socket.Close()
+			return "", err
+		}
+		if len(polled) > 0 {
+			break
+		}
+	}
+
+	reply, err := socket.RecvMessage(0)
+	if err != nil {
+		socket.Close()
+		return "", err
+	}
+	pool.put(endpoint, socket)
+	if len(reply) == 0 || reply[0] == ERROR_MSG {
+		return "", ErrDropped
+	}
+	return reply[0], nil
+}
@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Number of goroutines serving requests on each endpoint.
+const WORKERS = 8
+
+// How long a stopping endpoint waits for requests it has accepted to be answered.
+const DRAIN_TIMEOUT = 5 * time.Second
+
+// Handles one incoming request and returns the reply.
+type Handler func(msg string) (string, error)
+
+/*
+Carries requests between nodes.
+*/
+type Transport interface {
+	// Send msg to the node at address and wait for its reply.
+	SendMessage(msg string, address string) (string, error)
+	// As SendMessage, giving up once ctx is done.
+	SendMessageContext(ctx context.Context, msg string, address string) (string, error)
+	// Serve requests arriving at address until ctx is done. Requests already
+	// accepted are answered before Serve returns, and its workers have exited.
+	Serve(ctx context.Context, address string, handler Handler) error
+}
+
+/*
+Transport over ZeroMQ ROUTER/DEALER sockets.
+*/
+type ZmqTransport struct{}
+
+func (t ZmqTransport) SendMessage(msg string, address string) (string, error) {
+	return SendMessage(msg, address)
+}
+
+func (t ZmqTransport) SendMessageContext(ctx context.Context, msg string, address string) (string, error) {
+	return SendMessageContext(ctx, msg, address, DefaultSendOptions)
+}
+
+func (t ZmqTransport) Serve(ctx context.Context, address string, handler Handler) error {
+	context, err := zmq.NewContext()
+	if err != nil {
+		return err
+	}
+	// Term blocks until every socket is closed, so it must come last.
+	defer context.Term()
+
+	socket, _ := context.NewSocket(zmq.ROUTER)
+	defer socket.Close()
+	socket.SetLinger(0)
+	err = socket.Bind(address)
+	if err != nil {
+		return err
+	}
+
+	backend := fmt.Sprintf("inproc://%s", ComputeId(address, DEFAULT_BITS))
+	dealer, _ := context.NewSocket(zmq.DEALER)
+	defer dealer.Close()
+	dealer.SetLinger(0)
+	dealer.Bind(backend)
+
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	for i := 0; i < WORKERS; i++ {
+		Debug("[ZmqTransport: %s] worker threads spawned\n", address)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			zmqWorker(context, backend, handler, stop)
+		}()
+	}
+	Debug("[ZmqTransport: %s] Client bound\n", address)
+
+	err = zmqProxy(ctx, socket, dealer)
+	close(stop)
+	workers.Wait()
+	Debug("[ZmqTransport: %s] Stopped\n", address)
+	return err
+}
+
+// Pass requests from frontend to the workers behind backend, and their replies
+// back, until ctx is done and every accepted request has been answered.
+func zmqProxy(ctx context.Context, frontend *zmq.Socket, backend *zmq.Socket) error {
+	poller := zmq.NewPoller()
+	poller.Add(frontend, zmq.POLLIN)
+	poller.Add(backend, zmq.POLLIN)
+	inflight := 0
+	var drainDeadline time.Time
+	for {
+		if ctx.Err() != nil {
+			if drainDeadline.IsZero() {
+				// Stop accepting requests, but keep passing back replies.
+				drainDeadline = time.Now().Add(DRAIN_TIMEOUT)
+				poller = zmq.NewPoller()
+				poller.Add(backend, zmq.POLLIN)
+			}
+			if inflight <= 0 || time.Now().After(drainDeadline) {
+				return nil
+			}
+		}
+		polled, err := poller.Poll(POLL_INTERVAL)
+		if err != nil {
+			return err
+		}
+		for _, p := range polled {
+			if p.Socket == frontend {
+				msg, err := frontend.RecvMessage(0)
+				if err == nil {
+					backend.SendMessage(msg)
+					inflight++
+				}
+			} else {
+				msg, err := backend.RecvMessage(0)
+				if err == nil {
+					frontend.SendMessage(msg)
+					inflight--
+				}
+			}
+		}
+	}
+}
+
+func zmqWorker(context *zmq.Context, backend string, handler Handler, stop chan struct{}) {
+	worker, _ := context.NewSocket(zmq.DEALER)
+	defer worker.Close()
+	worker.SetLinger(0)
+	worker.Connect(backend)
+	poller := zmq.NewPoller()
+	poller.Add(worker, zmq.POLLIN)
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		polled, err := poller.Poll(POLL_INTERVAL)
+		if err != nil || len(polled) == 0 {
+			continue
+		}
+		msg, err := worker.RecvMessage(0)
+		if err != nil {
+			Debug("[ZmqTransport: %s] worker errord\n", backend)
+			continue
+		}
+		id, content, err := Pop(msg)
+		if err == nil && len(content) == 0 {
+			err = errors.New("Message has no content after the envelope")
+		}
+		if err != nil {
+			Debug("[ZmqTransport: %s] worker errord: %s\n", backend, err.Error())
+			// Answer what we can, so the sender is not left waiting for a reply.
+			if len(id) > 0 {
+				worker.SendMessage(id, EncodeReply(ErrorReply(ERR_MALFORMED, err.Error())))
+			}
+			continue
+		}
+		reply, err := handler(content[0])
+		if err != nil {
+			Debug("[ZmqTransport: %s] Sending Error msg: %s\n", backend, err.Error())
+			worker.SendMessage(id, ERROR_MSG)
+		} else {
+			worker.SendMessage(id, reply)
+		}
+	}
+}
+
+type memoryRequest struct {
+	msg	string
+	reply	chan memoryReply
+}
+
+type memoryReply struct {
+	msg	string
+	err	error
+}
+
+/*
+Transport that delivers requests over channels within a single process.
+*/
+type MemoryTransport struct {
+	mux		sync.RWMutex
+	endpoints	map[string]chan memoryRequest
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{endpoints: map[string]chan memoryRequest{}}
+}
+
+func (t *MemoryTransport) SendMessage(msg string, address string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultSendOptions.Timeout)
+	defer cancel()
+	return t.SendMessageContext(ctx, msg, address)
+}
+
+func (t *MemoryTransport) SendMessageContext(ctx context.Context, msg string, address string) (string, error) {
+	to, msg := tagVirtual(address, msg)
+	t.mux.RLock()
+	endpoint, present := t.endpoints[to]
+	t.mux.RUnlock()
+	if !present {
+		return "", &SendError{Address: address, Attempts: 1, Err: ErrDropped}
+	}
+	request := memoryRequest{msg: msg, reply: make(chan memoryReply, 1)}
+	select {
+	case endpoint <- request:
+	case <-ctx.Done():
+		return "", &SendError{Address: address, Attempts: 1, Err: ErrTimeout}
+	}
+	select {
+	case reply := <-request.reply:
+		// Match ZeroMQ, where a handler error reaches the sender as ERROR_MSG.
+		if reply.err != nil {
+			return "", &SendError{Address: address, Attempts: 1, Err: ErrDropped}
+		}
+		return reply.msg, nil
+	case <-ctx.Done():
+		return "", &SendError{Address: address, Attempts: 1, Err: ErrTimeout}
+	}
+}
+
+func (t *MemoryTransport) Serve(ctx context.Context, address string, handler Handler) error {
+	endpoint := make(chan memoryRequest)
+	t.mux.Lock()
+	if _, present := t.endpoints[address]; present {
+		t.mux.Unlock()
+		return errors.New("Address already in use: " + address)
+	}
+	t.endpoints[address] = endpoint
+	t.mux.Unlock()
+
+	handle := func(request memoryRequest) {
+		reply, err := handler(request.msg)
+		request.reply <- memoryReply{msg: reply, err: err}
+	}
+	closing := make(chan struct{})
+	var workers sync.WaitGroup
+	for i := 0; i < WORKERS; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case request := <-endpoint:
+					handle(request)
+				case <-closing:
+					// Answer senders that reached us before we went away.
+					for {
+						select {
+						case request := <-endpoint:
+							handle(request)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	t.mux.Lock()
+	delete(t.endpoints, address)
+	t.mux.Unlock()
+	close(closing)
+	workers.Wait()
+	return nil
+}
@@ -2,10 +2,8 @@ package utils
 
 import (
 	"crypto/sha1"
-	"encoding/binary"
 	"math/big"
 	"math/rand"
-	"strconv"
 	"os"
 	"errors"
 
@@ -21,24 +19,19 @@ const MaxPort = 47808
 const Localhost = "127.0.0.1"
 const ERROR_MSG = "NORESPONSE"
 
-func ComputeId(input string) uint32 {
+// Status values carried in key-value replies.
+const STATUS_OK = "ok"
+const STATUS_NOT_FOUND = "not-found"
+
+// The id of input in a ring of bits-bit ids.
+func ComputeId(input string, bits int) ID {
 	// Hash input
 	hash := sha1.New()
 	hash.Write([]byte(input))
-	hashed_in := hash.Sum(nil)
-
-	// Conver input to int
-	hash_big := new(big.Int)
-	hash_big.SetBytes(hashed_in)
+	hashed_in := new(big.Int).SetBytes(hash.Sum(nil))
 
 	// Mod chord size
-	size_big := new(big.Int)
-	size_big.Exp(big.NewInt(2), big.NewInt(32), nil)
-	result_big := new(big.Int)
-	result_big = hash_big.Mod(hash_big, size_big)
-
-	// Convert to uint32
-	return binary.BigEndian.Uint32(result_big.Bytes())
+	return IdFromBig(hashed_in.Mod(hashed_in, ringSize(bits)))
 }
 
 // From: https://github.com/pebbe/zmq4/blob/master/examples/asyncsrv.go
@@ -49,8 +42,8 @@ func SetId(socket *zmq.Socket) {
 
 // From: https://github.com/pebbe/zmq4/blob/master/examples/asyncsrv.go
 func Pop(msg []string) ([]string, []string, error) {
-	if len(msg) == 0 {
-		return msg, msg, errors.New("Empty array passed to pop]\n")
+	if len(msg) < 2 {
+		return msg, nil, errors.New("Message has no content after the identity")
 	}
 	var head []string
 	var tail []string
@@ -64,41 +57,17 @@ func Pop(msg []string) ([]string, []string, error) {
 	return head, tail, nil
 }
 
-func SendMessage(msg string, address string) (string, error) {
-	context, _ := zmq.NewContext()
-	defer context.Term()
-
-	socket, _ := context.NewSocket(zmq.DEALER)
-	defer socket.Close()
-
-	Debug("[SendMessage] Sending msg: %s to address: %s\n", msg, address)
-	SetId(socket)
-	socket.Connect(address)
-	socket.SendMessage(msg)
-
-	reply, err := socket.RecvMessage(0)
-	if reply[0] == ERROR_MSG || err != nil {
-		return "", errors.New("Dropped Message")
-	} else {
-		return string(reply[0]), nil
-	}
-}
-
 func GetRandomPort() int {
 	return rand.Intn(MaxPort-MinPort) + MinPort
 }
 
-func ParseToUInt32(input string) (uint32, error) {
-	result64, err := strconv.ParseUint(input, 10, 32)
-	if err != nil {
-		return 0, err
-	} else {
-		result := uint32(result64)
-		return result, nil
-	}
-}
+// Set to false to silence Debug.
+var DEBUG = true
 
 func Debug(log string, args ...string) {
+	if !DEBUG {
+		return
+	}
 	typed_args := make([]interface{}, len(args))
 	for i, v := range args {
 		typed_args[i] = v
@@ -106,14 +75,16 @@ func Debug(log string, args ...string) {
 	fmt.Fprintf(os.Stderr, log, typed_args...)
 }
 
-func IsBetween(start uint32, end uint32, val uint32) bool {
+func IsBetween(start ID, end ID, val ID) bool {
+	start_end, start_val, val_end := start.Cmp(end), start.Cmp(val), val.Cmp(end)
+
 	//---------------------------------------
 	// s = start  e = end   v = value
 	//     __v___|___e_
 	//    /      0     \
 	//   s              \
 	//  /                \
-	if (start > end) && (start < val) && (val > end) {
+	if (start_end > 0) && (start_val < 0) && (val_end > 0) {
 		return true
 	}
 
@@ -123,7 +94,7 @@ func IsBetween(start uint32, end uint32, val uint32) bool {
 	//    /      0     \
 	//   s              \
 	//  /                \
-	if (start > end) && (start > val) && (val < end) {
+	if (start_end > 0) && (start_val > 0) && (val_end < 0) {
 		return true
 	}
 
@@ -132,7 +103,7 @@ func IsBetween(start uint32, end uint32, val uint32) bool {
 	//  \                /
 	//   e              /
 	//    \___v______s_/
-	if (end > start) && (val > start) && (val < end) {
+	if (start_end < 0) && (start_val < 0) && (val_end < 0) {
 		return true
 	}
 
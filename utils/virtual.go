@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Virtual nodes share their host's transport endpoint. The first has the host's
+address and the ith after it the address with #i appended, e.g.
+tcp://127.0.0.1:5555#2. The transports send a message for a virtual node to its
+host's endpoint, prefixed with #i and a space, and the host hands it on.
+*/
+const VIRTUAL_TAG = "#"
+
+func VirtualAddress(host string, i int) string {
+	if i == 0 {
+		return host
+	}
+	return fmt.Sprintf("%s%s%d", host, VIRTUAL_TAG, i)
+}
+
+// The endpoint serving address, and which of its virtual nodes address is.
+func SplitVirtual(address string) (string, int) {
+	at := strings.LastIndex(address, VIRTUAL_TAG)
+	if at < 0 {
+		return address, 0
+	}
+	i, err := strconv.Atoi(address[at+len(VIRTUAL_TAG):])
+	if err != nil || i < 0 {
+		return address, 0
+	}
+	return address[:at], i
+}
+
+// Where to send msg to reach address, and what to send.
+func tagVirtual(address string, msg string) (string, string) {
+	endpoint, i := SplitVirtual(address)
+	if i == 0 {
+		return endpoint, msg
+	}
+	return endpoint, fmt.Sprintf("%s%d %s", VIRTUAL_TAG, i, msg)
+}
+
+// Which virtual node a message arriving at a host is for, and the message
+// itself. Untagged messages are for the first.
+func UntagVirtual(msg string) (int, string) {
+	if !strings.HasPrefix(msg, VIRTUAL_TAG) {
+		return 0, msg
+	}
+	space := strings.Index(msg, " ")
+	if space < 0 {
+		return -1, msg
+	}
+	i, err := strconv.Atoi(msg[len(VIRTUAL_TAG):space])
+	if err != nil || i < 0 {
+		return -1, msg
+	}
+	return i, msg[space+1:]
+}